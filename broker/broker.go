@@ -0,0 +1,413 @@
+// Package broker implements a minimal DSA broker which may be embedded in a Go process. Links
+// connect to it with the standard /conn handshake and are mounted under /downstream/<name>.
+// The broker routes list, subscribe, invoke, set and remove requests from requesters to the
+// responder owning the path, and exposes its own nodes under /sys.
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/butlermatt/dslink/log"
+	"github.com/gorilla/websocket"
+)
+
+// Version is the DSA protocol version reported by the broker.
+const Version = "1.1.2"
+
+// linkInfo is the body of a link's /conn request.
+type linkInfo struct {
+	PublicKey   string                 `json:"publicKey"`
+	IsRequester bool                   `json:"isRequester"`
+	IsResponder bool                   `json:"isResponder"`
+	LinkData    map[string]interface{} `json:"linkData"`
+	Version     string                 `json:"version"`
+	Formats     []string               `json:"formats"`
+	Compression bool                   `json:"enableWebSocketCompression"`
+}
+
+// connResp is the broker's response to a /conn request.
+type connResp struct {
+	Id        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	WsUri     string `json:"wsUri"`
+	Version   string `json:"version"`
+	TempKey   string `json:"tempKey"`
+	Salt      string `json:"salt"`
+	Path      string `json:"path"`
+	Format    string `json:"format"`
+}
+
+// session is the state of a link between its /conn request and its websocket connection.
+type session struct {
+	info      linkInfo
+	linkKey   crypto.PublicKey
+	handshake *crypto.Handshake
+	format    string
+	name      string
+	token     string
+}
+
+// Broker is an embeddable DSA broker. It implements http.Handler, serving the /conn and /ws
+// endpoints, so it may be mounted on an existing server or started with ListenAndServe.
+type Broker struct {
+	name    string
+	keys    crypto.KeyStore
+	tokens  *TokenStore
+	key     crypto.PrivateKey
+	ecdh    crypto.ECDH
+	formats []string
+	codecs  map[string]*conn.Encoder
+	started time.Time
+
+	upgrader websocket.Upgrader
+	server   *http.Server
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string]*session
+	links    map[string]*link // connected links by name
+	lists    map[*link]map[int32]string
+	values   map[string]*value // subscribed values by broker path
+	nextSid  int32
+	// dropped are the sids of values unsubscribed while their responder was disconnected,
+	// by the name of the responder, which are unsubscribed when it reconnects.
+	dropped map[string][]int32
+}
+
+// Name sets the name of the broker, which is used as the prefix of its dsId.
+// The default is "broker-".
+func Name(name string) func(b *Broker) {
+	return func(b *Broker) {
+		b.name = name
+	}
+}
+
+// KeyStore sets the store the broker loads its private key from. If the store does not
+// contain a key, one will be generated and saved to it. By default a new key is generated
+// each time the broker is created.
+func KeyStore(ks crypto.KeyStore) func(b *Broker) {
+	return func(b *Broker) {
+		b.keys = ks
+	}
+}
+
+// Tokens requires links to connect with a token from ts. By default any link may connect.
+func Tokens(ts *TokenStore) func(b *Broker) {
+	return func(b *Broker) {
+		b.tokens = ts
+	}
+}
+
+// Formats sets the message formats the broker supports, in order of preference.
+// The default is json then msgpack.
+func Formats(formats ...string) func(b *Broker) {
+	return func(b *Broker) {
+		b.formats = formats
+	}
+}
+
+// New creates a new Broker with the specified options.
+func New(opts ...func(b *Broker)) (*Broker, error) {
+	b := &Broker{
+		name:     "broker-",
+		ecdh:     crypto.NewECDH(),
+		formats:  []string{conn.JsonCodec.Format, conn.MsgpCodec.Format},
+		started:  time.Now(),
+		upgrader: websocket.Upgrader{EnableCompression: true},
+		codecs: map[string]*conn.Encoder{
+			conn.JsonCodec.Format: conn.JsonCodec,
+			conn.MsgpCodec.Format: conn.MsgpCodec,
+		},
+		sessions: make(map[string]*session),
+		links:    make(map[string]*link),
+		lists:    make(map[*link]map[int32]string),
+		values:   make(map[string]*value),
+		dropped:  make(map[string][]int32),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	for _, f := range b.formats {
+		if _, ok := b.codecs[f]; !ok {
+			return nil, fmt.Errorf("unsupported format %q", f)
+		}
+	}
+
+	var err error
+	if b.keys == nil {
+		b.keys = crypto.NewMemoryStore(nil)
+	}
+	if b.key, err = crypto.LoadOrCreate(b.keys); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// DsId returns the dsId of the broker.
+func (b *Broker) DsId() string {
+	return b.key.DsId(b.name)
+}
+
+// ListenAndServe listens on the TCP address addr and serves links until Close is called.
+func (b *Broker) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Serve accepts connections on the listener and serves links until Close is called.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = l.Close()
+		return http.ErrServerClosed
+	}
+	if b.server != nil {
+		b.mu.Unlock()
+		_ = l.Close()
+		return errors.New("broker is already serving")
+	}
+	b.server = &http.Server{Handler: b}
+	srv := b.server
+	b.mu.Unlock()
+
+	log.Infof("Broker %s listening on %s", b.DsId(), l.Addr())
+	return srv.Serve(l)
+}
+
+// Close disconnects all links and stops the server started by ListenAndServe or Serve.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	srv := b.server
+	links := make([]*link, 0, len(b.links))
+	for _, l := range b.links {
+		links = append(links, l)
+	}
+	b.mu.Unlock()
+
+	for _, l := range links {
+		l.close()
+	}
+
+	if srv != nil {
+		return srv.Close()
+	}
+	return nil
+}
+
+// ServeHTTP handles the /conn handshake and /ws websocket endpoints.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/conn":
+		b.handleConn(w, r)
+	case "/ws":
+		b.handleWs(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (b *Broker) handleConn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dsId := r.URL.Query().Get("dsId")
+	name := linkName(dsId)
+	if name == "" {
+		http.Error(w, "invalid dsId", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var info linkInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	linkKey, err := b.ecdh.UnmarshalPublic(info.PublicKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid public key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !linkKey.VerifyDsId(dsId) {
+		http.Error(w, "dsId does not match public key", http.StatusUnauthorized)
+		return
+	}
+
+	format := b.selectFormat(info.Formats)
+	if format == "" {
+		http.Error(w, "no supported format", http.StatusBadRequest)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if b.tokens != nil {
+		if _, err = b.tokens.Validate(dsId, token); err != nil {
+			log.Infof("Link %s refused: %v", dsId, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	hs, err := crypto.NewHandshake(rand.Reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		http.Error(w, "broker is closed", http.StatusServiceUnavailable)
+		return
+	}
+	name = b.uniqueName(dsId, name)
+	b.sessions[dsId] = &session{info: info, linkKey: linkKey, handshake: hs, format: format, name: name, token: token}
+	b.mu.Unlock()
+
+	resp := connResp{
+		Id:        b.DsId(),
+		PublicKey: b.key.PublicKey.Base64(),
+		WsUri:     "/ws",
+		Version:   Version,
+		TempKey:   hs.PublicTempKey(),
+		Salt:      hs.Salt,
+		Path:      downstream + "/" + name,
+		Format:    format,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (b *Broker) handleWs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dsId := q.Get("dsId")
+
+	b.mu.Lock()
+	s, ok := b.sessions[dsId]
+	delete(b.sessions, dsId)
+	b.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "no handshake for dsId", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.handshake.VerifyLink(dsId, s.linkKey, q.Get("auth")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The token is only used once the link has proven it holds the key of its dsId.
+	var permit string
+	if b.tokens != nil {
+		tok, err := b.tokens.Use(dsId, s.token)
+		if err != nil {
+			log.Infof("Link %s refused: %v", dsId, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		permit = tok.Permission
+	}
+
+	ws, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	l := newLink(b, ws, dsId, s.name, s.info, b.codecs[s.format])
+	l.permit = permit
+	if !b.addLink(l) {
+		l.close()
+		return
+	}
+
+	log.Infof("Link %s connected at %s", dsId, l.path)
+	go l.write()
+	l.read()
+}
+
+func (b *Broker) selectFormat(formats []string) string {
+	for _, bf := range b.formats {
+		for _, lf := range formats {
+			if bf == lf {
+				return bf
+			}
+		}
+	}
+	return ""
+}
+
+// uniqueName returns the name the link with dsId is mounted at. A link reconnecting with
+// the same dsId keeps its name, while a different link with the same name, whether connected
+// or still in its handshake, is given a suffix. Must be called with b.mu held.
+func (b *Broker) uniqueName(dsId, name string) string {
+	n := name
+	for i := 2; ; i++ {
+		if !b.nameTaken(dsId, n) {
+			return n
+		}
+		n = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// nameTaken reports whether name is used by a link or pending session other than dsId.
+// Must be called with b.mu held.
+func (b *Broker) nameTaken(dsId, name string) bool {
+	if l, ok := b.links[name]; ok && l.dsId != dsId {
+		return true
+	}
+	for id, s := range b.sessions {
+		if id != dsId && s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// linkName returns the name of a link from its dsId, which is the dsId without its public key
+// hash and trailing dash. Returns an empty string if the dsId is invalid.
+func linkName(dsId string) string {
+	if len(dsId) <= dsIdHashLength {
+		return ""
+	}
+	name := strings.TrimRight(dsId[:len(dsId)-dsIdHashLength], "-")
+	if name == "" || strings.ContainsAny(name, "/\\?*:|<>$@,'\"") {
+		return ""
+	}
+	return name
+}
+
+// dsIdHashLength is the length of the base64 public key hash at the end of a dsId.
+const dsIdHashLength = 43
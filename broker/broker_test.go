@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// testLink is a link connected to a broker without the conn package.
+type testLink struct {
+	t     *testing.T
+	ws    *websocket.Conn
+	codec *conn.Encoder
+	path  string
+	reqs  []*conn.Request
+	resps []*conn.Response
+	msg   int32
+}
+
+func newTestBroker(t *testing.T, opts ...func(b *Broker)) (*Broker, *httptest.Server) {
+	t.Helper()
+	b, err := New(opts...)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	srv := httptest.NewServer(b)
+	t.Cleanup(func() {
+		_ = b.Close()
+		srv.Close()
+	})
+	return b, srv
+}
+
+// handshake performs the /conn request of a link and returns its response and the link's key.
+func handshake(t *testing.T, srv *httptest.Server, name string, info linkInfo, query url.Values) (*http.Response, connResp, crypto.PrivateKey) {
+	t.Helper()
+	key, _ := crypto.NewECDH().GenerateKey(rand.Reader)
+	res, cr := handshakeKey(t, srv, key, name, info, query)
+	return res, cr, key
+}
+
+// handshakeKey performs the /conn request of a link with the specified key.
+func handshakeKey(t *testing.T, srv *httptest.Server, key crypto.PrivateKey, name string, info linkInfo, query url.Values) (*http.Response, connResp) {
+	t.Helper()
+	info.PublicKey = key.PublicKey.Base64()
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("dsId", key.DsId(name))
+
+	body, _ := json.Marshal(info)
+	res, err := http.Post(srv.URL+"/conn?"+query.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer res.Body.Close()
+
+	var cr connResp
+	if res.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(res.Body).Decode(&cr); err != nil {
+			t.Fatal("Unable to decode handshake response", err)
+		}
+	}
+	return res, cr
+}
+
+func dialLink(t *testing.T, srv *httptest.Server, name string, info linkInfo) *testLink {
+	t.Helper()
+	if info.Formats == nil {
+		info.Formats = []string{"json"}
+	}
+
+	res, cr, key := handshake(t, srv, name, info, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Handshake failed: %s", res.Status)
+	}
+
+	ecdh := crypto.NewECDH()
+	tmp, _ := ecdh.UnmarshalPublic(cr.TempKey)
+	auth := ecdh.HashSalt(cr.Salt, ecdh.GenerateSharedSecret(key, tmp))
+
+	q := url.Values{"dsId": {key.DsId(name)}, "auth": {auth}}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + cr.WsUri + "?" + q.Encode()
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal("Unable to connect websocket", err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+
+	codec := conn.JsonCodec
+	if cr.Format == conn.MsgpCodec.Format {
+		codec = conn.MsgpCodec
+	}
+	return &testLink{t: t, ws: ws, codec: codec, path: cr.Path}
+}
+
+func (tl *testLink) send(reqs []*conn.Request, resps []*conn.Response) {
+	tl.t.Helper()
+	tl.msg++
+	b, err := tl.codec.Marshal(&conn.Message{Msg: tl.msg, Requests: reqs, Responses: resps})
+	if err != nil {
+		tl.t.Fatal("Unexpected error", err)
+	}
+	if err = tl.ws.WriteMessage(tl.codec.MsgType, b); err != nil {
+		tl.t.Fatal("Unexpected error", err)
+	}
+}
+
+func (tl *testLink) request(reqs ...*conn.Request) {
+	tl.t.Helper()
+	tl.send(reqs, nil)
+}
+
+func (tl *testLink) respond(resps ...*conn.Response) {
+	tl.t.Helper()
+	tl.send(nil, resps)
+}
+
+// read reads the next message from the broker and queues its requests and responses.
+func (tl *testLink) read() {
+	tl.t.Helper()
+	_ = tl.ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, b, err := tl.ws.ReadMessage()
+	if err != nil {
+		tl.t.Fatal("Unable to read message", err)
+	}
+
+	var m conn.Message
+	if err = tl.codec.Unmarshal(b, &m); err != nil {
+		tl.t.Fatal("Unable to decode message", err)
+	}
+	tl.reqs = append(tl.reqs, m.Requests...)
+	tl.resps = append(tl.resps, m.Responses...)
+}
+
+// expectRequest returns the first request received matching method, discarding earlier requests.
+func (tl *testLink) expectRequest(method string) *conn.Request {
+	tl.t.Helper()
+	for {
+		for i, r := range tl.reqs {
+			if r.Method == method {
+				tl.reqs = tl.reqs[i+1:]
+				return r
+			}
+		}
+		tl.reqs = nil
+		tl.read()
+	}
+}
+
+// expectResponse returns the first response received for rid, discarding earlier responses.
+func (tl *testLink) expectResponse(rid int32) *conn.Response {
+	tl.t.Helper()
+	for {
+		for i, r := range tl.resps {
+			if r.Rid == rid {
+				tl.resps = tl.resps[i+1:]
+				return r
+			}
+		}
+		tl.resps = nil
+		tl.read()
+	}
+}
+
+func TestBroker_Handshake(t *testing.T) {
+	b, srv := newTestBroker(t)
+
+	res, cr, _ := handshake(t, srv, "test-", linkInfo{IsResponder: true, Formats: []string{"msgpack", "json"}}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Handshake failed: %s", res.Status)
+	}
+	if cr.Id != b.DsId() || cr.Path != "/downstream/test" || cr.Format != "json" || cr.WsUri != "/ws" {
+		t.Errorf("Unexpected handshake response: %+v", cr)
+	}
+
+	res, _, _ = handshake(t, srv, "test-", linkInfo{Formats: []string{"cbor"}}, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Handshake with unsupported format expected=%d got=%d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestBroker_BadAuth(t *testing.T) {
+	_, srv := newTestBroker(t)
+
+	_, cr, key := handshake(t, srv, "test-", linkInfo{Formats: []string{"json"}}, nil)
+	q := url.Values{"dsId": {key.DsId("test-")}, "auth": {"bad"}}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + cr.WsUri + "?" + q.Encode()
+	_, res, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		t.Fatal("Expected connection with invalid auth to fail")
+	}
+	if res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Invalid auth expected status %d got=%v", http.StatusUnauthorized, res)
+	}
+}
+
+func TestBroker_HttpClient(t *testing.T) {
+	b, srv := newTestBroker(t, Formats("msgpack"))
+	key, _ := crypto.NewECDH().GenerateKey(rand.Reader)
+
+	cl := conn.NewHttpClient(conn.IsResponder, conn.Name("sdk-"), conn.Key(&key), conn.Broker(srv.URL+"/conn"))
+	cl.Codec(conn.JsonCodec)
+	cl.Codec(conn.MsgpCodec)
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		l, ok := b.links["sdk"]
+		b.mu.Unlock()
+		if ok {
+			if l.dsId != key.DsId("sdk-") || l.codec != conn.MsgpCodec {
+				t.Errorf("Unexpected link: dsId=%q format=%q", l.dsId, l.codec.Format)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Link did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroker_UniqueName(t *testing.T) {
+	_, srv := newTestBroker(t)
+
+	a := dialLink(t, srv, "dup-", linkInfo{IsResponder: true})
+	c := dialLink(t, srv, "dup-", linkInfo{IsResponder: true})
+	if a.path != "/downstream/dup" {
+		t.Errorf("First link path expected=%q got=%q", "/downstream/dup", a.path)
+	}
+	if c.path != "/downstream/dup-2" {
+		t.Errorf("Second link path expected=%q got=%q", "/downstream/dup-2", c.path)
+	}
+}
+
+func TestBroker_UniqueNamePending(t *testing.T) {
+	_, srv := newTestBroker(t)
+
+	// A name is reserved from the handshake, before the link connects its websocket.
+	_, first, _ := handshake(t, srv, "dup-", linkInfo{Formats: []string{"json"}}, nil)
+	_, second, _ := handshake(t, srv, "dup-", linkInfo{Formats: []string{"json"}}, nil)
+	if first.Path != "/downstream/dup" {
+		t.Errorf("First link path expected=%q got=%q", "/downstream/dup", first.Path)
+	}
+	if second.Path != "/downstream/dup-2" {
+		t.Errorf("Second link path expected=%q got=%q", "/downstream/dup-2", second.Path)
+	}
+
+	c := dialLink(t, srv, "dup-", linkInfo{IsResponder: true})
+	if c.path != "/downstream/dup-3" {
+		t.Errorf("Connected link path expected=%q got=%q", "/downstream/dup-3", c.path)
+	}
+}
+
+func TestLinkName(t *testing.T) {
+	hash := strings.Repeat("a", dsIdHashLength)
+	tests := map[string]string{
+		"test-" + hash: "test",
+		"test" + hash:  "test",
+		hash:           "",
+		"a/b-" + hash:  "",
+		"short":        "",
+	}
+	for dsId, name := range tests {
+		if got := linkName(dsId); got != name {
+			t.Errorf("linkName(%q) expected=%q got=%q", dsId, name, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/log"
+	"github.com/gorilla/websocket"
+)
+
+// stream is a request forwarded from a requester to a responder.
+type stream struct {
+	req     *link
+	reqRid  int32
+	resp    *link
+	respRid int32
+	method  string
+	path    string
+}
+
+// link is a link connected to the broker. All fields other than those of the write queue
+// are guarded by the broker's mutex.
+type link struct {
+	b     *Broker
+	dsId  string
+	name  string
+	path  string
+	info  linkInfo
+	codec *conn.Encoder
+	ws    *websocket.Conn
+	// permit is the permission of the token the link connected with, which limits the
+	// requests it may make.
+	permit string
+
+	reqs    map[int32]*stream // streams requested by this link, by its rid
+	resps   map[int32]*stream // streams forwarded to this link, by the broker's rid
+	nextRid int32
+	subs    map[int32]string // subscriptions of this link, from its sid to the broker path
+	// upstream are the values subscribed on this link as a responder, by the broker's sid.
+	upstream map[int32]*value
+
+	wmu       sync.Mutex
+	msg       int32
+	ack       int32
+	requests  []*conn.Request
+	responses []*conn.Response
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLink(b *Broker, ws *websocket.Conn, dsId, name string, info linkInfo, codec *conn.Encoder) *link {
+	return &link{
+		b:        b,
+		dsId:     dsId,
+		name:     name,
+		path:     downstream + "/" + name,
+		info:     info,
+		codec:    codec,
+		ws:       ws,
+		reqs:     make(map[int32]*stream),
+		resps:    make(map[int32]*stream),
+		subs:     make(map[int32]string),
+		upstream: make(map[int32]*value),
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// permission returns the permission of a request r of l, which is the lower of the
+// permission of l's token and the permit of r. Requests without either have the full
+// permission of the broker.
+func (l *link) permission(r *conn.Request) conn.Permission {
+	p := conn.PermissionConfig
+	for _, permit := range []string{l.permit, r.Permit} {
+		if permit == "" {
+			continue
+		}
+		q, ok := conn.ParsePermission(permit)
+		if !ok {
+			return conn.PermissionNone
+		}
+		if q == conn.PermissionNever {
+			return q
+		}
+		if q < p {
+			p = q
+		}
+	}
+	return p
+}
+
+// sendRequest queues a request to be written to the link.
+func (l *link) sendRequest(req *conn.Request) {
+	l.wmu.Lock()
+	l.requests = append(l.requests, req)
+	l.wmu.Unlock()
+	l.signal()
+}
+
+// sendResponse queues a response to be written to the link.
+func (l *link) sendResponse(resp *conn.Response) {
+	l.wmu.Lock()
+	l.responses = append(l.responses, resp)
+	l.wmu.Unlock()
+	l.signal()
+}
+
+// acknowledge queues an ack of the message msg received from the link.
+func (l *link) acknowledge(msg int32) {
+	l.wmu.Lock()
+	l.ack = msg
+	l.wmu.Unlock()
+	l.signal()
+}
+
+func (l *link) signal() {
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+// write writes queued requests and responses to the link until it is closed. Everything
+// queued since the last write is sent in a single message.
+func (l *link) write() {
+	for {
+		select {
+		case <-l.notify:
+		case <-l.done:
+			return
+		}
+
+		l.wmu.Lock()
+		m := &conn.Message{Ack: l.ack, Requests: l.requests, Responses: l.responses}
+		if len(m.Requests) > 0 || len(m.Responses) > 0 {
+			l.msg++
+			m.Msg = l.msg
+		}
+		l.ack = 0
+		l.requests = nil
+		l.responses = nil
+		l.wmu.Unlock()
+
+		if m.Msg == 0 && m.Ack == 0 {
+			continue
+		}
+
+		b, err := l.codec.Marshal(m)
+		if err != nil {
+			log.Errorf("Unable to encode message for %s: %v", l.dsId, err)
+			continue
+		}
+		if err = l.ws.WriteMessage(l.codec.MsgType, b); err != nil {
+			l.close()
+			return
+		}
+	}
+}
+
+// read handles messages from the link until its connection is closed.
+func (l *link) read() {
+	defer l.b.removeLink(l)
+	defer l.close()
+
+	for {
+		_, b, err := l.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var m conn.Message
+		if err = l.codec.Unmarshal(b, &m); err != nil {
+			log.Warnf("Unable to decode message from %s: %v", l.dsId, err)
+			continue
+		}
+
+		if m.Msg != 0 {
+			l.acknowledge(m.Msg)
+		}
+		l.b.handle(l, &m)
+	}
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		_ = l.ws.Close()
+	})
+}
@@ -0,0 +1,533 @@
+package broker
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/log"
+)
+
+const (
+	downstream = "/downstream"
+	sys        = "/sys"
+)
+
+// value is a subscribed path. A value on a responder is subscribed to once, with a sid
+// chosen by the broker, and each update is sent to every subscriber with their own sid.
+type value struct {
+	path   string
+	sid    int32           // sid of the subscription on the responder
+	qos    int             // qos of the subscription on the responder
+	resp   *link           // responder the value is subscribed on, or nil
+	last   interface{}     // last update received
+	subs   map[*link]int32 // subscribers and their sids
+	subQos map[*link]int   // qos requested by each subscriber
+}
+
+// sysNodes are the value nodes under /sys and their types.
+var sysNodes = []struct{ name, typ string }{
+	{"version", "string"},
+	{"dsId", "string"},
+	{"startTime", "string"},
+	{"linkCount", "number"},
+}
+
+// addLink mounts a newly connected link under /downstream. A link already connected with
+// the same dsId is replaced. Returns false if the broker is closed.
+func (b *Broker) addLink(l *link) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return false
+	}
+
+	if old, ok := b.links[l.name]; ok {
+		if old.dsId == l.dsId {
+			b.detach(old)
+			old.close()
+		} else {
+			l.name = b.uniqueName(l.dsId, l.name)
+			l.path = downstream + "/" + l.name
+		}
+	}
+	b.links[l.name] = l
+
+	if l.info.IsResponder {
+		if sids := b.dropped[l.name]; len(sids) > 0 {
+			delete(b.dropped, l.name)
+			l.nextRid++
+			l.sendRequest(&conn.Request{Rid: l.nextRid, Method: conn.MethodUnsubscribe, Sids: sids})
+		}
+		for _, v := range b.values {
+			if v.resp == nil && isChild(l.path, v.path) {
+				b.subscribeUpstream(v, l)
+			}
+		}
+	}
+
+	b.notifyLists(downstream, []interface{}{[]interface{}{l.name, linkNode(l)}})
+	b.setSys("linkCount", len(b.links))
+	return true
+}
+
+// removeLink unmounts a disconnected link, closing the streams it was part of.
+func (b *Broker) removeLink(l *link) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.detach(l)
+	if b.links[l.name] != l {
+		return
+	}
+	delete(b.links, l.name)
+
+	log.Infof("Link %s disconnected from %s", l.dsId, l.path)
+	b.notifyLists(downstream, []interface{}{map[string]interface{}{"name": l.name, "change": "remove"}})
+	b.setSys("linkCount", len(b.links))
+}
+
+// detach closes all streams and subscriptions of a link. Must be called with b.mu held.
+func (b *Broker) detach(l *link) {
+	for rid, s := range l.reqs {
+		delete(l.reqs, rid)
+		delete(s.resp.resps, s.respRid)
+		s.resp.sendRequest(&conn.Request{Rid: s.respRid, Method: conn.MethodClose})
+	}
+
+	for rid, s := range l.resps {
+		delete(l.resps, rid)
+		delete(s.req.reqs, s.reqRid)
+		s.req.sendResponse(conn.ClosedResponse(s.reqRid, conn.NewError(conn.ErrDisconnected, "%s disconnected", l.path)))
+	}
+
+	for sid := range l.subs {
+		b.unsubscribeSid(l, sid)
+	}
+
+	// Subscribers of the link's values remain, and are resubscribed when it reconnects.
+	for sid, v := range l.upstream {
+		delete(l.upstream, sid)
+		v.resp = nil
+	}
+
+	delete(b.lists, l)
+}
+
+// handle routes the requests and responses of a message received from l.
+func (b *Broker) handle(l *link, m *conn.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.links[l.name] != l {
+		return
+	}
+
+	for _, req := range m.Requests {
+		if req != nil {
+			b.handleRequest(l, req)
+		}
+	}
+	for _, resp := range m.Responses {
+		if resp != nil {
+			b.handleResponse(l, resp)
+		}
+	}
+}
+
+func (b *Broker) handleRequest(l *link, req *conn.Request) {
+	if !l.info.IsRequester {
+		l.sendResponse(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrPermissionDenied, "link is not a requester")))
+		return
+	}
+
+	switch req.Method {
+	case conn.MethodSubscribe:
+		if !l.permission(req).Allows(conn.PermissionRead) {
+			l.sendResponse(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrPermissionDenied, "no permission to subscribe")))
+			return
+		}
+		b.subscribe(l, req)
+	case conn.MethodUnsubscribe:
+		for _, sid := range req.Sids {
+			b.unsubscribeSid(l, sid)
+		}
+		l.sendResponse(conn.ClosedResponse(req.Rid, nil))
+	case conn.MethodClose:
+		b.closeStream(l, req.Rid)
+	case conn.MethodList, conn.MethodInvoke, conn.MethodSet, conn.MethodRemove:
+		path := conn.CleanPath(req.Path)
+		if resp, rel := b.responder(path); resp != nil {
+			b.forward(l, resp, rel, req)
+			return
+		}
+
+		updates, ok := b.localNode(path)
+		if !ok {
+			l.sendResponse(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrInvalidPath, "no node at %s", path)))
+			return
+		}
+		if req.Method != conn.MethodList || !l.permission(req).Allows(conn.PermissionList) {
+			l.sendResponse(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrPermissionDenied, "cannot %s %s", req.Method, path)))
+			return
+		}
+
+		if b.lists[l] == nil {
+			b.lists[l] = make(map[int32]string)
+		}
+		b.lists[l][req.Rid] = path
+		l.sendResponse(&conn.Response{Rid: req.Rid, Stream: conn.StreamOpen, Updates: updates})
+	default:
+		l.sendResponse(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrInvalidMethod, "unknown method %q", req.Method)))
+	}
+}
+
+func (b *Broker) handleResponse(l *link, resp *conn.Response) {
+	if resp.Rid == 0 {
+		b.update(l, resp.Updates)
+		return
+	}
+
+	s, ok := l.resps[resp.Rid]
+	if !ok {
+		return
+	}
+
+	out := *resp
+	out.Rid = s.reqRid
+	s.req.sendResponse(&out)
+
+	if resp.Stream == conn.StreamClosed {
+		delete(l.resps, s.respRid)
+		delete(s.req.reqs, s.reqRid)
+	}
+}
+
+// responder returns the responder link mounted at or above path, and path relative to it.
+func (b *Broker) responder(path string) (*link, string) {
+	if !isChild(downstream, path) || path == downstream {
+		return nil, ""
+	}
+
+	l, ok := b.links[mountName(path)]
+	if !ok || !l.info.IsResponder {
+		return nil, ""
+	}
+	return l, conn.CleanPath(strings.TrimPrefix(path, l.path))
+}
+
+// forward sends a request from req to the responder resp, using a rid of the broker.
+func (b *Broker) forward(req, resp *link, path string, r *conn.Request) {
+	if _, ok := req.reqs[r.Rid]; ok {
+		b.closeStream(req, r.Rid)
+	}
+
+	resp.nextRid++
+	s := &stream{req: req, reqRid: r.Rid, resp: resp, respRid: resp.nextRid, method: r.Method, path: path}
+	req.reqs[s.reqRid] = s
+	resp.resps[s.respRid] = s
+
+	fwd := *r
+	fwd.Rid = s.respRid
+	fwd.Path = path
+	if req.permit != "" {
+		fwd.Permit = req.permission(r).String()
+	}
+	resp.sendRequest(&fwd)
+}
+
+// closeStream closes the stream rid requested by l.
+func (b *Broker) closeStream(l *link, rid int32) {
+	if s, ok := l.reqs[rid]; ok {
+		delete(l.reqs, rid)
+		delete(s.resp.resps, s.respRid)
+		s.resp.sendRequest(&conn.Request{Rid: s.respRid, Method: conn.MethodClose})
+		return
+	}
+	delete(b.lists[l], rid)
+}
+
+func (b *Broker) subscribe(l *link, req *conn.Request) {
+	for _, p := range req.Paths {
+		if p == nil {
+			continue
+		}
+		path := conn.CleanPath(p.Path)
+
+		if old, ok := l.subs[p.Sid]; ok && old != path {
+			b.unsubscribeSid(l, p.Sid)
+		}
+
+		v, ok := b.values[path]
+		if !ok {
+			v = &value{path: path, qos: p.Qos, subs: make(map[*link]int32), subQos: make(map[*link]int)}
+			b.values[path] = v
+			if name, ok := sysName(path); ok {
+				v.last = sysUpdate(b.sysValue(name))
+			} else if resp, _ := b.responder(path); resp != nil {
+				b.subscribeUpstream(v, resp)
+			}
+		}
+
+		if sid, ok := v.subs[l]; ok && sid != p.Sid {
+			delete(l.subs, sid)
+		}
+		v.subs[l] = p.Sid
+		l.subs[p.Sid] = path
+		v.subQos[l] = p.Qos
+		b.updateQos(v)
+
+		if v.last != nil {
+			l.sendResponse(&conn.Response{Updates: []interface{}{withSid(v.last, p.Sid)}})
+		}
+	}
+
+	l.sendResponse(conn.ClosedResponse(req.Rid, nil))
+}
+
+// subscribeUpstream subscribes to a value on its responder. A value keeps its sid when its
+// responder reconnects, so the responder renews the subscription it kept.
+func (b *Broker) subscribeUpstream(v *value, resp *link) {
+	if v.sid == 0 {
+		b.nextSid++
+		v.sid = b.nextSid
+	}
+	v.resp = resp
+	resp.upstream[v.sid] = v
+	b.sendSubscribe(v)
+}
+
+// sendSubscribe sends the subscription of v to its responder. A subscribe request for an
+// existing sid updates its qos.
+func (b *Broker) sendSubscribe(v *value) {
+	v.resp.nextRid++
+	v.resp.sendRequest(&conn.Request{
+		Rid:    v.resp.nextRid,
+		Method: conn.MethodSubscribe,
+		Paths:  []*conn.SubscribePath{{Path: conn.CleanPath(strings.TrimPrefix(v.path, v.resp.path)), Sid: v.sid, Qos: v.qos}},
+	})
+}
+
+// updateQos subscribes v on its responder with the highest qos of its subscribers, if
+// that has changed.
+func (b *Broker) updateQos(v *value) {
+	qos := 0
+	for _, q := range v.subQos {
+		if q > qos {
+			qos = q
+		}
+	}
+	if qos == v.qos {
+		return
+	}
+
+	v.qos = qos
+	if v.resp != nil {
+		b.sendSubscribe(v)
+	}
+}
+
+// unsubscribeSid removes the subscription sid of l, unsubscribing from the responder if it
+// was the last subscriber of the value.
+func (b *Broker) unsubscribeSid(l *link, sid int32) {
+	path, ok := l.subs[sid]
+	if !ok {
+		return
+	}
+	delete(l.subs, sid)
+
+	v, ok := b.values[path]
+	if !ok || v.subs[l] != sid {
+		return
+	}
+	delete(v.subs, l)
+	delete(v.subQos, l)
+	if len(v.subs) > 0 {
+		b.updateQos(v)
+		return
+	}
+
+	delete(b.values, path)
+	if v.resp != nil {
+		delete(v.resp.upstream, v.sid)
+		v.resp.nextRid++
+		v.resp.sendRequest(&conn.Request{Rid: v.resp.nextRid, Method: conn.MethodUnsubscribe, Sids: []int32{v.sid}})
+	} else if v.sid != 0 {
+		name := mountName(v.path)
+		b.dropped[name] = append(b.dropped[name], v.sid)
+	}
+}
+
+// update sends the subscription updates received from the responder l to the subscribers.
+func (b *Broker) update(l *link, updates []interface{}) {
+	out := make(map[*link][]interface{})
+	for _, u := range updates {
+		sid, ok := updateSid(u)
+		if !ok {
+			continue
+		}
+
+		v, ok := l.upstream[sid]
+		if !ok {
+			continue
+		}
+		v.last = u
+		for sub, ssid := range v.subs {
+			out[sub] = append(out[sub], withSid(u, ssid))
+		}
+	}
+
+	for sub, u := range out {
+		sub.sendResponse(&conn.Response{Updates: u})
+	}
+}
+
+// setSys updates the value of the /sys node name and sends it to any subscribers.
+func (b *Broker) setSys(name string, val interface{}) {
+	v, ok := b.values[sys+"/"+name]
+	if !ok {
+		return
+	}
+
+	v.last = sysUpdate(val)
+	for sub, sid := range v.subs {
+		sub.sendResponse(&conn.Response{Updates: []interface{}{withSid(v.last, sid)}})
+	}
+}
+
+func (b *Broker) sysValue(name string) interface{} {
+	switch name {
+	case "version":
+		return Version
+	case "dsId":
+		return b.DsId()
+	case "startTime":
+		return b.started.Format(conn.TimeFormat)
+	case "linkCount":
+		return len(b.links)
+	}
+	return nil
+}
+
+// notifyLists sends updates to all requesters listing the local node at path.
+func (b *Broker) notifyLists(path string, updates []interface{}) {
+	for l, rids := range b.lists {
+		for rid, p := range rids {
+			if p == path {
+				l.sendResponse(&conn.Response{Rid: rid, Stream: conn.StreamOpen, Updates: updates})
+			}
+		}
+	}
+}
+
+// localNode returns the list updates of a node of the broker itself.
+func (b *Broker) localNode(path string) ([]interface{}, bool) {
+	switch path {
+	case "/":
+		return []interface{}{
+			[]interface{}{"$is", "dsa/broker"},
+			[]interface{}{"downstream", map[string]interface{}{"$is": "node"}},
+			[]interface{}{"sys", map[string]interface{}{"$is": "node"}},
+		}, true
+	case downstream:
+		names := make([]string, 0, len(b.links))
+		for name := range b.links {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		updates := []interface{}{[]interface{}{"$is", "node"}}
+		for _, name := range names {
+			updates = append(updates, []interface{}{name, linkNode(b.links[name])})
+		}
+		return updates, true
+	case sys:
+		updates := []interface{}{[]interface{}{"$is", "node"}}
+		for _, n := range sysNodes {
+			updates = append(updates, []interface{}{n.name, map[string]interface{}{"$is": "node", "$type": n.typ}})
+		}
+		return updates, true
+	}
+
+	if name, ok := sysName(path); ok {
+		for _, n := range sysNodes {
+			if n.name == name {
+				return []interface{}{[]interface{}{"$is", "node"}, []interface{}{"$type", n.typ}}, true
+			}
+		}
+	}
+
+	// A link which is not a responder has no nodes of its own.
+	if l, ok := b.links[strings.TrimPrefix(path, downstream+"/")]; ok && l.path == path {
+		return []interface{}{[]interface{}{"$is", "dsa/link"}}, true
+	}
+
+	return nil, false
+}
+
+// linkNode returns the attributes of a link listed under /downstream.
+func linkNode(l *link) map[string]interface{} {
+	return map[string]interface{}{"$is": "dsa/link", "$linkData": l.info.LinkData}
+}
+
+// sysName returns the name of the /sys node at path.
+func sysName(path string) (string, bool) {
+	if !strings.HasPrefix(path, sys+"/") {
+		return "", false
+	}
+	name := strings.TrimPrefix(path, sys+"/")
+	for _, n := range sysNodes {
+		if n.name == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func sysUpdate(val interface{}) []interface{} {
+	return []interface{}{0, val, time.Now().Format(conn.TimeFormat)}
+}
+
+// mountName returns the name of the link mounted at or above path under /downstream.
+func mountName(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, downstream+"/"), "/", 2)[0]
+}
+
+// isChild returns true if path is parent or a descendant of it.
+func isChild(parent, path string) bool {
+	return path == parent || strings.HasPrefix(path, parent+"/")
+}
+
+// updateSid returns the sid of a subscription update in either the list or map form.
+func updateSid(u interface{}) (int32, bool) {
+	switch u := u.(type) {
+	case []interface{}:
+		if len(u) > 0 {
+			return conn.Int32(u[0])
+		}
+	case map[string]interface{}:
+		return conn.Int32(u["sid"])
+	}
+	return 0, false
+}
+
+// withSid returns a copy of the subscription update u with its sid replaced.
+func withSid(u interface{}, sid int32) interface{} {
+	switch u := u.(type) {
+	case []interface{}:
+		c := make([]interface{}, len(u))
+		copy(c, u)
+		c[0] = sid
+		return c
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(u))
+		for k, v := range u {
+			c[k] = v
+		}
+		c["sid"] = sid
+		return c
+	}
+	return u
+}
@@ -0,0 +1,336 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/node"
+)
+
+func TestRouter_ListLocal(t *testing.T) {
+	_, srv := newTestBroker(t)
+	req := dialLink(t, srv, "req-", linkInfo{IsRequester: true})
+
+	req.request(&conn.Request{Rid: 1, Method: conn.MethodList, Path: "/"})
+	resp := req.expectResponse(1)
+	if resp.Stream != conn.StreamOpen || len(resp.Updates) != 3 {
+		t.Errorf("Unexpected list response of /: %+v", resp)
+	}
+
+	req.request(&conn.Request{Rid: 2, Method: conn.MethodList, Path: "/downstream"})
+	resp = req.expectResponse(2)
+	if len(resp.Updates) != 2 || resp.Updates[1].([]interface{})[0] != "req" {
+		t.Errorf("Unexpected list response of /downstream: %+v", resp.Updates)
+	}
+
+	// Connecting and disconnecting links updates the list stream.
+	other := dialLink(t, srv, "other-", linkInfo{IsResponder: true})
+	resp = req.expectResponse(2)
+	if u := resp.Updates[0].([]interface{}); u[0] != "other" {
+		t.Errorf("Unexpected list update on connect: %+v", resp.Updates)
+	}
+	_ = other.ws.Close()
+	resp = req.expectResponse(2)
+	if u := resp.Updates[0].(map[string]interface{}); u["name"] != "other" || u["change"] != "remove" {
+		t.Errorf("Unexpected list update on disconnect: %+v", resp.Updates)
+	}
+
+	req.request(&conn.Request{Rid: 3, Method: conn.MethodList, Path: "/missing"})
+	resp = req.expectResponse(3)
+	if resp.Stream != conn.StreamClosed || resp.Error == nil || resp.Error.Type != conn.ErrInvalidPath {
+		t.Errorf("Unexpected response to list of missing node: %+v", resp)
+	}
+
+	req.request(&conn.Request{Rid: 4, Method: conn.MethodSet, Path: "/sys/version", Value: "2"})
+	resp = req.expectResponse(4)
+	if resp.Error == nil || resp.Error.Type != conn.ErrPermissionDenied {
+		t.Errorf("Unexpected response to set of /sys/version: %+v", resp)
+	}
+}
+
+func TestRouter_Forward(t *testing.T) {
+	_, srv := newTestBroker(t)
+	req := dialLink(t, srv, "req-", linkInfo{IsRequester: true, Formats: []string{"msgpack"}})
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+
+	req.request(&conn.Request{Rid: 7, Method: conn.MethodInvoke, Path: "/downstream/resp/act", Params: map[string]interface{}{"a": map[string]interface{}{"b": 1}}})
+	fwd := resp.expectRequest(conn.MethodInvoke)
+	if fwd.Path != "/act" {
+		t.Errorf("Forwarded path expected=%q got=%q", "/act", fwd.Path)
+	}
+	if a, ok := fwd.Params["a"].(map[string]interface{}); !ok || a["b"] != float64(1) {
+		t.Errorf("Forwarded params unexpected: %#v", fwd.Params)
+	}
+
+	resp.respond(&conn.Response{Rid: fwd.Rid, Stream: conn.StreamClosed, Updates: []interface{}{[]interface{}{"ok"}}})
+	r := req.expectResponse(7)
+	if r.Stream != conn.StreamClosed || !reflect.DeepEqual(r.Updates, []interface{}{[]interface{}{"ok"}}) {
+		t.Errorf("Unexpected forwarded response: %+v", r)
+	}
+
+	// Streams to a responder are closed with an error when it disconnects.
+	req.request(&conn.Request{Rid: 8, Method: conn.MethodList, Path: "/downstream/resp"})
+	fwd = resp.expectRequest(conn.MethodList)
+	if fwd.Path != "/" {
+		t.Errorf("Forwarded list path expected=%q got=%q", "/", fwd.Path)
+	}
+	_ = resp.ws.Close()
+	r = req.expectResponse(8)
+	if r.Stream != conn.StreamClosed || r.Error == nil || r.Error.Type != conn.ErrDisconnected {
+		t.Errorf("Unexpected response after responder disconnected: %+v", r)
+	}
+}
+
+func TestRouter_CloseStream(t *testing.T) {
+	_, srv := newTestBroker(t)
+	req := dialLink(t, srv, "req-", linkInfo{IsRequester: true})
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+
+	req.request(&conn.Request{Rid: 1, Method: conn.MethodList, Path: "/downstream/resp/node"})
+	fwd := resp.expectRequest(conn.MethodList)
+
+	req.request(&conn.Request{Rid: 1, Method: conn.MethodClose})
+	cl := resp.expectRequest(conn.MethodClose)
+	if cl.Rid != fwd.Rid {
+		t.Errorf("Close rid expected=%d got=%d", fwd.Rid, cl.Rid)
+	}
+}
+
+func TestRouter_Subscribe(t *testing.T) {
+	_, srv := newTestBroker(t)
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+	a := dialLink(t, srv, "a-", linkInfo{IsRequester: true})
+	b := dialLink(t, srv, "b-", linkInfo{IsRequester: true, Formats: []string{"msgpack"}})
+
+	a.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/downstream/resp/v", Sid: 10}}})
+	sub := resp.expectRequest(conn.MethodSubscribe)
+	if len(sub.Paths) != 1 || sub.Paths[0].Path != "/v" {
+		t.Fatalf("Unexpected upstream subscribe: %+v", sub)
+	}
+	if r := a.expectResponse(1); r.Stream != conn.StreamClosed {
+		t.Errorf("Unexpected subscribe response: %+v", r)
+	}
+
+	sid := sub.Paths[0].Sid
+	resp.respond(&conn.Response{Rid: 0, Updates: []interface{}{[]interface{}{sid, 42, "ts"}}})
+	u := a.expectResponse(0)
+	if !reflect.DeepEqual(u.Updates, []interface{}{[]interface{}{float64(10), float64(42), "ts"}}) {
+		t.Errorf("Unexpected update: %#v", u.Updates)
+	}
+
+	// A second subscriber shares the upstream subscription and receives the last value.
+	b.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/downstream/resp/v", Sid: 3}}})
+	u = b.expectResponse(0)
+	if s, _ := conn.Int32(u.Updates[0].([]interface{})[0]); s != 3 {
+		t.Errorf("Second subscriber sid expected=%d got=%v", 3, u.Updates)
+	}
+
+	resp.respond(&conn.Response{Rid: 0, Updates: []interface{}{map[string]interface{}{"sid": sid, "value": "x", "ts": "ts"}}})
+	if u = a.expectResponse(0); u.Updates[0].(map[string]interface{})["sid"] != float64(10) {
+		t.Errorf("Unexpected map update for a: %#v", u.Updates)
+	}
+	if u = b.expectResponse(0); u.Updates[0].(map[string]interface{})["value"] != "x" {
+		t.Errorf("Unexpected map update for b: %#v", u.Updates)
+	}
+
+	// The upstream subscription is removed with the last subscriber.
+	a.request(&conn.Request{Rid: 2, Method: conn.MethodUnsubscribe, Sids: []int32{10}})
+	a.expectResponse(2)
+	b.request(&conn.Request{Rid: 2, Method: conn.MethodUnsubscribe, Sids: []int32{3}})
+	unsub := resp.expectRequest(conn.MethodUnsubscribe)
+	if len(unsub.Sids) != 1 || unsub.Sids[0] != sid {
+		t.Errorf("Unexpected upstream unsubscribe: %+v", unsub)
+	}
+}
+
+func TestRouter_SubscribeQos(t *testing.T) {
+	_, srv := newTestBroker(t)
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+	a := dialLink(t, srv, "a-", linkInfo{IsRequester: true})
+	b := dialLink(t, srv, "b-", linkInfo{IsRequester: true})
+
+	a.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/downstream/resp/v", Sid: 1, Qos: 1}}})
+	sub := resp.expectRequest(conn.MethodSubscribe)
+	if sub.Paths[0].Qos != 1 {
+		t.Errorf("Upstream qos expected=1 got=%d", sub.Paths[0].Qos)
+	}
+	sid := sub.Paths[0].Sid
+
+	// The upstream subscription is renewed with the highest qos of its subscribers.
+	b.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/downstream/resp/v", Sid: 1, Qos: 3}}})
+	sub = resp.expectRequest(conn.MethodSubscribe)
+	if p := sub.Paths[0]; p.Sid != sid || p.Qos != 3 {
+		t.Errorf("Renewed upstream subscription expected sid=%d qos=3 got=%+v", sid, p)
+	}
+
+	b.request(&conn.Request{Rid: 2, Method: conn.MethodUnsubscribe, Sids: []int32{1}})
+	sub = resp.expectRequest(conn.MethodSubscribe)
+	if p := sub.Paths[0]; p.Sid != sid || p.Qos != 1 {
+		t.Errorf("Renewed upstream subscription expected sid=%d qos=1 got=%+v", sid, p)
+	}
+}
+
+func TestRouter_SubscribeSys(t *testing.T) {
+	_, srv := newTestBroker(t)
+	a := dialLink(t, srv, "a-", linkInfo{IsRequester: true})
+
+	a.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/sys/linkCount", Sid: 1}}})
+	u := a.expectResponse(0)
+	if v := u.Updates[0].([]interface{})[1]; v != float64(1) {
+		t.Errorf("linkCount expected=%v got=%v", 1, v)
+	}
+
+	dialLink(t, srv, "b-", linkInfo{IsResponder: true})
+	u = a.expectResponse(0)
+	if v := u.Updates[0].([]interface{})[1]; v != float64(2) {
+		t.Errorf("linkCount expected=%v got=%v", 2, v)
+	}
+}
+
+func TestRouter_NotRequester(t *testing.T) {
+	_, srv := newTestBroker(t)
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+
+	resp.request(&conn.Request{Rid: 1, Method: conn.MethodList, Path: "/"})
+	r := resp.expectResponse(1)
+	if r.Error == nil || r.Error.Type != conn.ErrPermissionDenied {
+		t.Errorf("Unexpected response to request from responder: %+v", r)
+	}
+}
+
+// setPermit sets the permission of the token of the connected link name.
+func setPermit(t *testing.T, b *Broker, name, permit string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		l, ok := b.links[name]
+		if ok {
+			l.permit = permit
+		}
+		b.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Link %s did not connect", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouter_Permit(t *testing.T) {
+	b, srv := newTestBroker(t)
+	req := dialLink(t, srv, "req-", linkInfo{IsRequester: true})
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+
+	// A token allowing only list may list the broker's nodes, but not subscribe.
+	setPermit(t, b, "req", "list")
+	req.request(&conn.Request{Rid: 1, Method: conn.MethodList, Path: "/sys"})
+	if r := req.expectResponse(1); r.Error != nil {
+		t.Errorf("Unexpected error listing /sys: %+v", r.Error)
+	}
+	req.request(&conn.Request{Rid: 2, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/sys/version", Sid: 1}}})
+	if r := req.expectResponse(2); r.Error == nil || r.Error.Type != conn.ErrPermissionDenied {
+		t.Errorf("Unexpected response to subscribe with list permission: %+v", r)
+	}
+
+	// Forwarded requests have the lower of the token's permission and their permit.
+	req.request(&conn.Request{Rid: 3, Method: conn.MethodInvoke, Path: "/downstream/resp/act", Permit: "config"})
+	if fwd := resp.expectRequest(conn.MethodInvoke); fwd.Permit != "list" {
+		t.Errorf("Forwarded permit expected=%q got=%q", "list", fwd.Permit)
+	}
+	setPermit(t, b, "req", "write")
+	req.request(&conn.Request{Rid: 4, Method: conn.MethodInvoke, Path: "/downstream/resp/act", Permit: "read"})
+	if fwd := resp.expectRequest(conn.MethodInvoke); fwd.Permit != "read" {
+		t.Errorf("Forwarded permit expected=%q got=%q", "read", fwd.Permit)
+	}
+
+	setPermit(t, b, "req", "none")
+	req.request(&conn.Request{Rid: 5, Method: conn.MethodList, Path: "/downstream"})
+	if r := req.expectResponse(5); r.Error == nil || r.Error.Type != conn.ErrPermissionDenied {
+		t.Errorf("Unexpected response to list with no permission: %+v", r)
+	}
+}
+
+func TestRouter_Reconnect(t *testing.T) {
+	b, srv := newTestBroker(t)
+	req := dialLink(t, srv, "req-", linkInfo{IsRequester: true})
+	resp := dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+
+	tree := node.NewTree()
+	n, _ := tree.Root().CreateChild("n", node.Value(1.0))
+	_, _ = tree.Root().CreateChild("m", node.Value(1.0))
+	r := node.NewResponder(tree, func(r *conn.Response) { resp.respond(r) })
+	defer r.Close()
+
+	req.request(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{
+		{Path: "/downstream/resp/n", Sid: 1, Qos: node.QosDurable},
+		{Path: "/downstream/resp/m", Sid: 2, Qos: node.QosDurable},
+	}})
+	sub := resp.expectRequest(conn.MethodSubscribe)
+	r.Handle(sub)
+	r.Handle(resp.expectRequest(conn.MethodSubscribe))
+	if vs := updates(req, 2); len(vs) != 2 {
+		t.Errorf("Expected initial values of sids 1 and 2 got=%v", vs)
+	}
+
+	// The responder queues updates while disconnected, and the requester drops one value.
+	_ = resp.ws.Close()
+	r.Disconnected()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		_, ok := b.links["resp"]
+		b.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Responder did not disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.SetValue(2.0)
+	req.request(&conn.Request{Rid: 2, Method: conn.MethodUnsubscribe, Sids: []int32{2}})
+	req.expectResponse(2)
+
+	// On reconnect, the broker unsubscribes the dropped value and renews the kept one with
+	// the same sid.
+	resp = dialLink(t, srv, "resp-", linkInfo{IsResponder: true})
+	unsub := resp.expectRequest(conn.MethodUnsubscribe)
+	if len(unsub.Sids) != 1 || unsub.Sids[0] == sub.Paths[0].Sid {
+		t.Errorf("Unexpected unsubscribe on reconnect: %v", unsub.Sids)
+	}
+	r.Handle(unsub)
+	renew := resp.expectRequest(conn.MethodSubscribe)
+	if len(renew.Paths) != 1 || renew.Paths[0].Path != "/n" || renew.Paths[0].Sid != sub.Paths[0].Sid {
+		t.Errorf("Renewed subscription expected /n sid %d got=%+v", sub.Paths[0].Sid, renew.Paths[0])
+	}
+	r.Handle(renew)
+	r.Resume()
+
+	if vs := updates(req, 1); vs[1] != 2.0 {
+		t.Errorf("Queued update expected sid 1 value 2 got=%v", vs)
+	}
+}
+
+// updates reads subscription updates received by tl until it has count, and returns their
+// values by sid.
+func updates(tl *testLink, count int) map[int32]interface{} {
+	tl.t.Helper()
+	vs := make(map[int32]interface{})
+	for n := 0; n < count; {
+		for _, u := range tl.expectResponse(0).Updates {
+			vu, err := conn.ParseValueUpdate(u)
+			if err != nil {
+				tl.t.Fatal("Unexpected error", err)
+			}
+			vs[vu.Sid] = vu.Value
+			n++
+		}
+	}
+	return vs
+}
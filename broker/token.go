@@ -0,0 +1,329 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/butlermatt/dslink/internal/fsutil"
+)
+
+const (
+	// tokenSecretLength is the length of the secret which follows the id of a token.
+	tokenSecretLength = 32
+	// tokenFileMode is the permission token files are written with, as they contain secrets.
+	tokenFileMode os.FileMode = 0600
+	tokenChars                = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	// ErrTokenInvalid is returned when a token query parameter does not match a known token.
+	ErrTokenInvalid = errors.New("invalid token")
+	// ErrTokenExpired is returned when a token has passed its expiry time.
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenUsedUp is returned when a token has been used by its maximum number of links.
+	ErrTokenUsedUp = errors.New("token has reached its maximum number of uses")
+)
+
+// Token allows links to connect to a broker which requires tokens. Links are given the
+// full token, which is the Id followed by the Secret, and send the Id followed by a hash
+// of their dsId and the full token in the token query parameter of the handshake.
+type Token struct {
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+	// Owner is the dsId or user which created the token.
+	Owner string `json:"owner,omitempty"`
+	// Permission is the highest permission granted to links which connect with the token.
+	// If empty, links are not restricted.
+	Permission string `json:"permission,omitempty"`
+	// Expires is when the token stops being accepted. A zero time never expires.
+	Expires time.Time `json:"expires"`
+	// MaxUses is the number of links which may connect with the token, or 0 for no limit.
+	MaxUses int `json:"maxUses,omitempty"`
+	// Links are the dsIds of the links which have connected with the token.
+	Links   []string  `json:"links,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// String returns the full token to be given to links.
+func (t Token) String() string {
+	return t.Id + t.Secret
+}
+
+// Expired returns true if the token has expired at time now.
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// ExpiresAt sets the time a token expires.
+func ExpiresAt(expires time.Time) func(t *Token) {
+	return func(t *Token) {
+		t.Expires = expires
+	}
+}
+
+// ExpiresIn sets a token to expire after d.
+func ExpiresIn(d time.Duration) func(t *Token) {
+	return func(t *Token) {
+		t.Expires = time.Now().Add(d)
+	}
+}
+
+// MaxUses sets the number of links which may connect with a token.
+func MaxUses(n int) func(t *Token) {
+	return func(t *Token) {
+		t.MaxUses = n
+	}
+}
+
+// Permission sets the highest permission granted to links which connect with a token, such
+// as "read". It must name a level of conn.Permission.
+func Permission(p string) func(t *Token) {
+	return func(t *Token) {
+		t.Permission = p
+	}
+}
+
+// TokenStore holds the tokens of a broker and validates the tokens of links. Tokens are
+// persisted as JSON to the store's file after every change.
+type TokenStore struct {
+	path string
+	ecdh crypto.ECDH
+
+	mu     sync.Mutex
+	tokens map[string]*Token
+}
+
+// NewTokenStore returns a TokenStore persisted to the file at path, loading any tokens it
+// contains. If path is empty, tokens are only held in memory.
+func NewTokenStore(path string) (*TokenStore, error) {
+	ts := &TokenStore{path: path, ecdh: crypto.NewECDH(), tokens: make(map[string]*Token)}
+	if path == "" {
+		return ts, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tokens from %q: %v", path, err)
+	}
+
+	var tokens []*Token
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("unable to decode tokens from %q: %v", path, err)
+	}
+	for _, t := range tokens {
+		if len(t.Id) != crypto.TokenIdLength {
+			return nil, fmt.Errorf("invalid token id %q in %q", t.Id, path)
+		}
+		if _, ok := conn.ParsePermission(t.Permission); t.Permission != "" && !ok {
+			return nil, fmt.Errorf("invalid permission %q of token %s in %q", t.Permission, t.Id, path)
+		}
+		ts.tokens[t.Id] = t
+	}
+
+	return ts, nil
+}
+
+// Create generates and saves a new token owned by owner.
+func (ts *TokenStore) Create(owner string, opts ...func(t *Token)) (Token, error) {
+	id, err := randomString(crypto.TokenIdLength)
+	if err != nil {
+		return Token{}, err
+	}
+	secret, err := randomString(tokenSecretLength)
+	if err != nil {
+		return Token{}, err
+	}
+
+	t := &Token{Id: id, Secret: secret, Owner: owner, Created: time.Now().UTC()}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if _, ok := conn.ParsePermission(t.Permission); t.Permission != "" && !ok {
+		return Token{}, fmt.Errorf("invalid token permission %q", t.Permission)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, ok := ts.tokens[id]; ok {
+		return Token{}, errors.New("token id collision")
+	}
+	ts.tokens[id] = t
+	if err = ts.save(); err != nil {
+		delete(ts.tokens, id)
+		return Token{}, err
+	}
+
+	return t.copy(), nil
+}
+
+// Get returns the token with the specified id.
+func (ts *TokenStore) Get(id string) (Token, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.tokens[id]
+	if !ok {
+		return Token{}, false
+	}
+	return t.copy(), true
+}
+
+// Tokens returns the tokens owned by owner, or all tokens if owner is empty, oldest first.
+func (ts *TokenStore) Tokens(owner string) []Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var tokens []Token
+	for _, t := range ts.tokens {
+		if owner == "" || t.Owner == owner {
+			tokens = append(tokens, t.copy())
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Id < tokens[j].Id
+		}
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Remove deletes the token with the specified id. Links already connected with the token
+// remain connected.
+func (ts *TokenStore) Remove(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.tokens[id]
+	if !ok {
+		return ErrTokenInvalid
+	}
+	delete(ts.tokens, id)
+	if err := ts.save(); err != nil {
+		ts.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+// Validate checks the token query parameter of the link dsId without recording a use of
+// the token. Returns the token, or an error if it is invalid, expired or used up.
+func (ts *TokenStore) Validate(dsId, param string) (Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, err := ts.check(dsId, param)
+	if err != nil {
+		return Token{}, err
+	}
+	return t.copy(), nil
+}
+
+// Use checks the token query parameter of the link dsId like Validate, and records the link
+// as a use of the token. A link which has already connected with the token does not use it
+// again.
+func (ts *TokenStore) Use(dsId, param string) (Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, err := ts.check(dsId, param)
+	if err != nil {
+		return Token{}, err
+	}
+	if t.used(dsId) {
+		return t.copy(), nil
+	}
+
+	t.Links = append(t.Links, dsId)
+	if err = ts.save(); err != nil {
+		t.Links = t.Links[:len(t.Links)-1]
+		return Token{}, err
+	}
+	return t.copy(), nil
+}
+
+// check returns the token of the query parameter of the link dsId, or an error if it is
+// invalid, expired or used up by other links. Must be called with ts.mu held.
+func (ts *TokenStore) check(dsId, param string) (*Token, error) {
+	if len(param) <= crypto.TokenIdLength {
+		return nil, ErrTokenInvalid
+	}
+
+	t, ok := ts.tokens[param[:crypto.TokenIdLength]]
+	if !ok || !crypto.VerifyHashToken(ts.ecdh, param, dsId, t.String()) {
+		return nil, ErrTokenInvalid
+	}
+	if t.Expired(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+	if !t.used(dsId) && t.MaxUses > 0 && len(t.Links) >= t.MaxUses {
+		return nil, ErrTokenUsedUp
+	}
+	return t, nil
+}
+
+// save writes the tokens to the store's file. Must be called with ts.mu held.
+func (ts *TokenStore) save() error {
+	if ts.path == "" {
+		return nil
+	}
+
+	tokens := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Id < tokens[j].Id })
+
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = fsutil.WriteFileAtomic(ts.path, b, tokenFileMode); err != nil {
+		return fmt.Errorf("unable to save tokens to %q: %v", ts.path, err)
+	}
+	return nil
+}
+
+// used reports whether the link dsId has connected with t.
+func (t *Token) used(dsId string) bool {
+	for _, l := range t.Links {
+		if l == dsId {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Token) copy() Token {
+	c := *t
+	c.Links = append([]string(nil), t.Links...)
+	return c
+}
+
+// randomString returns a random string of n alphanumeric characters.
+func randomString(n int) (string, error) {
+	max := big.NewInt(int64(len(tokenChars)))
+	b := make([]byte, n)
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = tokenChars[c.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,230 @@
+package broker
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/gorilla/websocket"
+)
+
+func tokenParam(dsId string, tok Token) string {
+	return tok.Id + crypto.NewECDH().HashToken(dsId, tok.String())
+}
+
+func TestTokenStore_Create(t *testing.T) {
+	ts, _ := NewTokenStore("")
+
+	tok, err := ts.Create("owner", MaxUses(2), Permission("read"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(tok.Id) != crypto.TokenIdLength || len(tok.Secret) != tokenSecretLength {
+		t.Errorf("Unexpected token lengths: id=%q secret=%q", tok.Id, tok.Secret)
+	}
+	if tok.Owner != "owner" || tok.MaxUses != 2 || tok.Permission != "read" || !tok.Expires.IsZero() {
+		t.Errorf("Unexpected token: %+v", tok)
+	}
+
+	other, _ := ts.Create("other")
+	if other.Id == tok.Id {
+		t.Error("Tokens created with the same id")
+	}
+	if _, err = ts.Create("owner", Permission("admin")); err == nil {
+		t.Error("Expected error creating token with invalid permission")
+	}
+
+	if toks := ts.Tokens("owner"); len(toks) != 1 || toks[0].Id != tok.Id {
+		t.Errorf("Tokens(owner) unexpected: %+v", toks)
+	}
+	if toks := ts.Tokens(""); len(toks) != 2 {
+		t.Errorf("Tokens() expected=2 got=%d", len(toks))
+	}
+
+	if err = ts.Remove(tok.Id); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, ok := ts.Get(tok.Id); ok {
+		t.Error("Removed token still exists")
+	}
+	if err = ts.Remove(tok.Id); err != ErrTokenInvalid {
+		t.Errorf("Remove of missing token expected=%v got=%v", ErrTokenInvalid, err)
+	}
+}
+
+func TestTokenStore_Validate(t *testing.T) {
+	ts, _ := NewTokenStore("")
+	tok, _ := ts.Create("", MaxUses(1))
+
+	// Validating does not use the token.
+	if _, err := ts.Validate("link-b", tokenParam("link-b", tok)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if got, _ := ts.Get(tok.Id); len(got.Links) != 0 {
+		t.Errorf("Validate recorded token links: %v", got.Links)
+	}
+
+	if _, err := ts.Use("link-a", tokenParam("link-a", tok)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// The same link may reconnect without using the token again.
+	if _, err := ts.Use("link-a", tokenParam("link-a", tok)); err != nil {
+		t.Error("Unexpected error on reconnect", err)
+	}
+	if _, err := ts.Validate("link-a", tokenParam("link-a", tok)); err != nil {
+		t.Error("Unexpected error validating reconnect", err)
+	}
+	if _, err := ts.Validate("link-b", tokenParam("link-b", tok)); err != ErrTokenUsedUp {
+		t.Errorf("Validate of used token expected=%v got=%v", ErrTokenUsedUp, err)
+	}
+	if _, err := ts.Use("link-b", tokenParam("link-b", tok)); err != ErrTokenUsedUp {
+		t.Errorf("Use of used token expected=%v got=%v", ErrTokenUsedUp, err)
+	}
+	if got, _ := ts.Get(tok.Id); len(got.Links) != 1 || got.Links[0] != "link-a" {
+		t.Errorf("Token links unexpected: %v", got.Links)
+	}
+
+	tests := map[string]string{
+		"hash of other dsId": tokenParam("link-b", tok),
+		"id only":            tok.Id,
+		"unknown id":         "0000000000000000" + tokenParam("link-a", tok)[crypto.TokenIdLength:],
+		"empty":              "",
+	}
+	for name, param := range tests {
+		if _, err := ts.Validate("link-a", param); err != ErrTokenInvalid {
+			t.Errorf("Validate %s expected=%v got=%v", name, ErrTokenInvalid, err)
+		}
+	}
+
+	expired, _ := ts.Create("", ExpiresAt(time.Now().Add(-time.Second)))
+	if _, err := ts.Validate("link-a", tokenParam("link-a", expired)); err != ErrTokenExpired {
+		t.Errorf("Validate of expired token expected=%v got=%v", ErrTokenExpired, err)
+	}
+}
+
+func TestTokenStore_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	tok, _ := ts.Create("owner", ExpiresIn(time.Hour), MaxUses(3))
+	if _, err = ts.Use("link-a", tokenParam("link-a", tok)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if fi.Mode().Perm() != tokenFileMode {
+		t.Errorf("Token file mode expected=%v got=%v", tokenFileMode, fi.Mode().Perm())
+	}
+
+	loaded, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	got, ok := loaded.Get(tok.Id)
+	if !ok {
+		t.Fatal("Token was not persisted")
+	}
+	if got.String() != tok.String() || !got.Expires.Equal(tok.Expires) || got.MaxUses != 3 || len(got.Links) != 1 {
+		t.Errorf("Loaded token expected=%+v got=%+v", tok, got)
+	}
+
+	_ = ioutil.WriteFile(path, []byte("not json"), 0600)
+	if _, err = NewTokenStore(path); err == nil {
+		t.Error("Expected error loading invalid token file")
+	}
+
+	bad := fmt.Sprintf(`[{"id":%q,"secret":"s","permission":"admin"}]`, tok.Id)
+	_ = ioutil.WriteFile(path, []byte(bad), 0600)
+	if _, err = NewTokenStore(path); err == nil {
+		t.Error("Expected error loading token with invalid permission")
+	}
+}
+
+func TestBroker_Tokens(t *testing.T) {
+	ts, _ := NewTokenStore("")
+	tok, _ := ts.Create("", Permission("read"))
+	b, srv := newTestBroker(t, Tokens(ts))
+
+	res, _, _ := handshake(t, srv, "none-", linkInfo{Formats: []string{"json"}}, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Handshake without token expected=%d got=%d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	bad := url.Values{"token": {tok.Id + "invalid"}}
+	res, _, _ = handshake(t, srv, "bad-", linkInfo{Formats: []string{"json"}}, bad)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Handshake with invalid token expected=%d got=%d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	key, _ := crypto.NewECDH().GenerateKey(rand.Reader)
+	cl := conn.NewHttpClient(conn.IsResponder, conn.Name("sdk-"), conn.Key(&key), conn.Broker(srv.URL+"/conn"), conn.Token(tok.String()))
+	cl.Codec(conn.JsonCodec)
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial with token failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		l, ok := b.links["sdk"]
+		b.mu.Unlock()
+		if ok {
+			if l.permit != "read" {
+				t.Errorf("Link permit expected=%q got=%q", "read", l.permit)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Link did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroker_TokenUsedAfterAuth(t *testing.T) {
+	ts, _ := NewTokenStore("")
+	tok, _ := ts.Create("", MaxUses(1))
+	_, srv := newTestBroker(t, Tokens(ts))
+
+	// A link which fails to authenticate its websocket does not use up the token.
+	key, _ := crypto.NewECDH().GenerateKey(rand.Reader)
+	dsId := key.DsId("first-")
+	query := url.Values{"token": {tokenParam(dsId, tok)}}
+	res, cr := handshakeKey(t, srv, key, "first-", linkInfo{Formats: []string{"json"}}, query)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Handshake failed: %s", res.Status)
+	}
+	q := url.Values{"dsId": {dsId}, "auth": {"bad"}}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + cr.WsUri + "?" + q.Encode()
+	if _, _, err := websocket.DefaultDialer.Dial(u, nil); err == nil {
+		t.Fatal("Expected connection with invalid auth to fail")
+	}
+	if got, _ := ts.Get(tok.Id); len(got.Links) != 0 {
+		t.Fatalf("Unauthenticated link used the token: %v", got.Links)
+	}
+
+	key, _ = crypto.NewECDH().GenerateKey(rand.Reader)
+	cl := conn.NewHttpClient(conn.IsResponder, conn.Name("second-"), conn.Key(&key), conn.Broker(srv.URL+"/conn"), conn.Token(tok.String()))
+	cl.Codec(conn.JsonCodec)
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial with token failed: %v", err)
+	}
+	if got, _ := ts.Get(tok.Id); len(got.Links) != 1 || got.Links[0] != key.DsId("second-") {
+		t.Errorf("Token links unexpected: %v", got.Links)
+	}
+}
@@ -1,7 +1,9 @@
 package conn
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
@@ -41,8 +43,38 @@ func init() {
 			return msgpack.Marshal(v)
 		},
 		Unmarshal: func(data []byte, v interface{}) error {
-			return msgpack.Unmarshal(data, v)
+			d := msgpack.NewDecoder(bytes.NewReader(data))
+			d.DecodeMapFunc = decodeStringMap
+			return d.Decode(v)
 		},
 	}
 
 }
+
+// decodeStringMap decodes msgpack maps as map[string]interface{}, as they are decoded from
+// json, so values received in one format may be sent in the other.
+func decodeStringMap(d *msgpack.Decoder) (interface{}, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil || n == -1 {
+		return nil, err
+	}
+
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,241 @@
+// Package conntest provides an in-process mock broker for testing links. The broker implements the
+// /conn handshake and the websocket endpoint of a DSA broker, verifying the link's dsId and auth with
+// the crypto package, and lets tests send frames to, and assert frames from, connected links.
+package conntest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// LinkInfo is the body of a link's /conn request.
+type LinkInfo struct {
+	PublicKey   string                 `json:"publicKey"`
+	IsRequester bool                   `json:"isRequester"`
+	IsResponder bool                   `json:"isResponder"`
+	LinkData    map[string]interface{} `json:"linkData"`
+	Version     string                 `json:"version"`
+	Formats     []string               `json:"formats"`
+	Compression bool                   `json:"enableWebSocketCompression"`
+}
+
+// connResp is the broker's response to a /conn request.
+type connResp struct {
+	Id        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	WsUri     string `json:"wsUri"`
+	HttpUri   string `json:"httpUri"`
+	Version   string `json:"version"`
+	TempKey   string `json:"tempKey"`
+	Salt      string `json:"salt"`
+	Path      string `json:"path"`
+	Format    string `json:"format"`
+}
+
+// session is the state of a link between its /conn request and its websocket connection.
+type session struct {
+	info      LinkInfo
+	linkKey   crypto.PublicKey
+	handshake *crypto.Handshake
+	format    string
+}
+
+// Broker is a mock DSA broker served by an httptest.Server.
+type Broker struct {
+	// URL is the address links should connect to, ending in /conn.
+	URL string
+	// Formats are the message formats the broker supports, in order of preference.
+	// The default is json then msgpack.
+	Formats []string
+	// Token, if set, is required in the token query parameter of each handshake.
+	Token string
+
+	server   *httptest.Server
+	key      crypto.PrivateKey
+	ecdh     crypto.ECDH
+	upgrader websocket.Upgrader
+	codecs   map[string]*conn.Encoder
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	conns    chan *Conn
+}
+
+// NewBroker starts and returns a new Broker. The caller should call Close when finished.
+func NewBroker() *Broker {
+	ecdh := crypto.NewECDH()
+	key, err := ecdh.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("conntest: unable to generate broker key: %v", err))
+	}
+
+	b := &Broker{
+		Formats:  []string{conn.JsonCodec.Format, conn.MsgpCodec.Format},
+		key:      key,
+		ecdh:     ecdh,
+		upgrader: websocket.Upgrader{EnableCompression: true},
+		codecs: map[string]*conn.Encoder{
+			conn.JsonCodec.Format: conn.JsonCodec,
+			conn.MsgpCodec.Format: conn.MsgpCodec,
+		},
+		sessions: make(map[string]*session),
+		conns:    make(chan *Conn, 16),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conn", b.handleConn)
+	mux.HandleFunc("/ws", b.handleWs)
+	b.server = httptest.NewServer(mux)
+	b.URL = b.server.URL + "/conn"
+
+	return b
+}
+
+// Close shuts down the broker and blocks until all requests have completed.
+func (b *Broker) Close() {
+	b.server.CloseClientConnections()
+	b.server.Close()
+}
+
+// Accept waits for a link to complete the handshake and connect to the websocket endpoint.
+// Returns an error if no link connects within timeout.
+func (b *Broker) Accept(timeout time.Duration) (*Conn, error) {
+	select {
+	case c := <-b.conns:
+		return c, nil
+	case <-time.After(timeout):
+		return nil, errors.New("conntest: timed out waiting for link to connect")
+	}
+}
+
+func (b *Broker) handleConn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dsId := r.URL.Query().Get("dsId")
+	if dsId == "" {
+		http.Error(w, "missing dsId", http.StatusBadRequest)
+		return
+	}
+
+	if !b.verifyToken(dsId, r.URL.Query().Get("token")) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var info LinkInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	linkKey, err := b.ecdh.UnmarshalPublic(info.PublicKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid public key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !linkKey.VerifyDsId(dsId) {
+		http.Error(w, "dsId does not match public key", http.StatusUnauthorized)
+		return
+	}
+
+	format := b.selectFormat(info.Formats)
+	if format == "" {
+		http.Error(w, "no supported format", http.StatusBadRequest)
+		return
+	}
+
+	hs, err := crypto.NewHandshake(rand.Reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b.mu.Lock()
+	b.sessions[dsId] = &session{info: info, linkKey: linkKey, handshake: hs, format: format}
+	b.mu.Unlock()
+
+	resp := connResp{
+		Id:        b.key.DsId("broker-"),
+		PublicKey: b.key.PublicKey.Base64(),
+		WsUri:     "/ws",
+		Version:   "1.1.2",
+		TempKey:   hs.PublicTempKey(),
+		Salt:      hs.Salt,
+		Path:      "/downstream/" + dsId,
+		Format:    format,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (b *Broker) handleWs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dsId := q.Get("dsId")
+
+	b.mu.Lock()
+	s, ok := b.sessions[dsId]
+	delete(b.sessions, dsId)
+	b.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "no handshake for dsId", http.StatusUnauthorized)
+		return
+	}
+
+	if !b.verifyToken(dsId, q.Get("token")) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.handshake.VerifyLink(dsId, s.linkKey, q.Get("auth")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := newConn(ws, dsId, s.info, b.codecs[s.format])
+	b.conns <- c
+}
+
+func (b *Broker) verifyToken(dsId, param string) bool {
+	if b.Token == "" {
+		return true
+	}
+	return crypto.VerifyHashToken(b.ecdh, param, dsId, b.Token)
+}
+
+func (b *Broker) selectFormat(formats []string) string {
+	for _, bf := range b.Formats {
+		for _, lf := range formats {
+			if bf == lf {
+				return bf
+			}
+		}
+	}
+	return ""
+}
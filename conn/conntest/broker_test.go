@@ -0,0 +1,103 @@
+package conntest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// dialLink performs the link side of the handshake without the conn package.
+func dialLink(t *testing.T, b *Broker, badAuth bool) (*websocket.Conn, error) {
+	t.Helper()
+	ecdh := crypto.NewECDH()
+	key, _ := ecdh.GenerateKey(rand.Reader)
+	dsId := key.DsId("test-")
+
+	body, _ := json.Marshal(LinkInfo{PublicKey: key.PublicKey.Base64(), IsResponder: true, Formats: []string{"json"}})
+	res, err := http.Post(b.URL+"?dsId="+url.QueryEscape(dsId), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer res.Body.Close()
+
+	var cr connResp
+	if err = json.NewDecoder(res.Body).Decode(&cr); err != nil {
+		t.Fatal("Unable to decode handshake response", err)
+	}
+	if cr.Format != "json" || cr.WsUri != "/ws" || cr.TempKey == "" || cr.Salt == "" {
+		t.Fatalf("Unexpected handshake response: %+v", cr)
+	}
+
+	tmp, _ := ecdh.UnmarshalPublic(cr.TempKey)
+	auth := ecdh.HashSalt(cr.Salt, ecdh.GenerateSharedSecret(key, tmp))
+	if badAuth {
+		auth = ecdh.HashSalt("wrong", ecdh.GenerateSharedSecret(key, tmp))
+	}
+
+	q := url.Values{"dsId": {dsId}, "auth": {auth}}
+	u := "ws" + strings.TrimPrefix(strings.TrimSuffix(b.URL, "/conn"), "http") + cr.WsUri + "?" + q.Encode()
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	return ws, err
+}
+
+func TestBroker_Frames(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ws, err := dialLink(t, b, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer ws.Close()
+
+	c, err := b.Accept(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Send(Frame{"msg": 1, "requests": []interface{}{}}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, m, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !strings.Contains(string(m), `"msg":1`) {
+		t.Errorf("Link received unexpected frame: %s", m)
+	}
+
+	_ = ws.WriteMessage(websocket.TextMessage, []byte(`{"msg":1}`))
+	_ = ws.WriteMessage(websocket.TextMessage, []byte(`{"msg":2,"ack":1}`))
+	f, err := c.Expect(time.Second, func(f Frame) bool { return f["ack"] != nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f["msg"] != float64(2) {
+		t.Errorf("Expected frame msg expected=2 got=%v", f["msg"])
+	}
+
+	ws.Close()
+	if _, err = c.Receive(time.Second); err == nil {
+		t.Error("Receive succeeded on closed connection")
+	}
+}
+
+func TestBroker_BadAuth(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	if _, err := dialLink(t, b, true); err == nil {
+		t.Error("Websocket connection accepted with invalid auth")
+	}
+	if _, err := b.Accept(10 * time.Millisecond); err == nil {
+		t.Error("Broker accepted a link with invalid auth")
+	}
+}
@@ -0,0 +1,111 @@
+package conntest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/gorilla/websocket"
+)
+
+// Frame is a single decoded websocket message, such as {"msg": 1, "requests": [...]}.
+type Frame map[string]interface{}
+
+// Conn is the broker side of a link's websocket connection.
+type Conn struct {
+	// DsId is the dsId of the connected link.
+	DsId string
+	// Info is the body of the link's /conn request.
+	Info LinkInfo
+	// Codec is the Encoder of the format selected for the link.
+	Codec *conn.Encoder
+
+	ws     *websocket.Conn
+	wmu    sync.Mutex
+	frames chan Frame
+	errc   chan error
+}
+
+func newConn(ws *websocket.Conn, dsId string, info LinkInfo, codec *conn.Encoder) *Conn {
+	c := &Conn{
+		DsId:   dsId,
+		Info:   info,
+		Codec:  codec,
+		ws:     ws,
+		frames: make(chan Frame, 64),
+		errc:   make(chan error, 1),
+	}
+
+	go c.read()
+	return c
+}
+
+// Send encodes the frame with the link's format and writes it to the link.
+func (c *Conn) Send(f Frame) error {
+	b, err := c.Codec.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("conntest: unable to encode frame: %v", err)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.ws.WriteMessage(c.Codec.MsgType, b)
+}
+
+// Receive waits for the next frame from the link.
+// Returns an error if the connection is closed or no frame arrives within timeout.
+func (c *Conn) Receive(timeout time.Duration) (Frame, error) {
+	select {
+	case f := <-c.frames:
+		return f, nil
+	case err := <-c.errc:
+		c.errc <- err
+		return nil, err
+	case <-time.After(timeout):
+		return nil, errors.New("conntest: timed out waiting for frame")
+	}
+}
+
+// Expect receives frames until one satisfies match, discarding the others, such as ping frames.
+// Returns the matching frame, or an error if none arrives within timeout.
+func (c *Conn) Expect(timeout time.Duration, match func(f Frame) bool) (Frame, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, errors.New("conntest: timed out waiting for matching frame")
+		}
+
+		f, err := c.Receive(remaining)
+		if err != nil {
+			return nil, err
+		}
+		if match(f) {
+			return f, nil
+		}
+	}
+}
+
+// Close closes the connection to the link.
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *Conn) read() {
+	for {
+		_, b, err := c.ws.ReadMessage()
+		if err != nil {
+			c.errc <- err
+			return
+		}
+
+		var f Frame
+		if err = c.Codec.Unmarshal(b, &f); err != nil {
+			c.errc <- fmt.Errorf("conntest: unable to decode frame: %v", err)
+			return
+		}
+		c.frames <- f
+	}
+}
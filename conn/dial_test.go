@@ -0,0 +1,104 @@
+package conn_test
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/conn/conntest"
+	"github.com/butlermatt/dslink/crypto"
+)
+
+func newKey(t *testing.T) *crypto.PrivateKey {
+	t.Helper()
+	km := crypto.NewECDH()
+	key, err := km.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating private key", err)
+	}
+	return &key
+}
+
+func TestHttpClient_Dial(t *testing.T) {
+	b := conntest.NewBroker()
+	defer b.Close()
+
+	key := newKey(t)
+	cl := conn.NewHttpClient(conn.IsResponder, conn.Name("test-"), conn.Key(key), conn.Broker(b.URL))
+	cl.Codec(conn.JsonCodec)
+
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	c, err := b.Accept(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DsId != key.DsId("test-") {
+		t.Errorf("Conn.DsId expected=%q got=%q", key.DsId("test-"), c.DsId)
+	}
+	if !c.Info.IsResponder || c.Info.IsRequester {
+		t.Errorf("Conn.Info flags expected responder only. got=%+v", c.Info)
+	}
+	if c.Codec != conn.JsonCodec {
+		t.Errorf("Conn.Codec expected=%q got=%q", conn.JsonCodec.Format, c.Codec.Format)
+	}
+}
+
+func TestHttpClient_DialFormat(t *testing.T) {
+	b := conntest.NewBroker()
+	b.Formats = []string{conn.MsgpCodec.Format, conn.JsonCodec.Format}
+	defer b.Close()
+
+	cl := conn.NewHttpClient(conn.Name("test-"), conn.Key(newKey(t)), conn.Broker(b.URL))
+	cl.Codec(conn.JsonCodec)
+	cl.Codec(conn.MsgpCodec)
+
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	c, err := b.Accept(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Codec != conn.MsgpCodec {
+		t.Errorf("Conn.Codec expected=%q got=%q", conn.MsgpCodec.Format, c.Codec.Format)
+	}
+}
+
+func TestHttpClient_DialToken(t *testing.T) {
+	b := conntest.NewBroker()
+	b.Token = "abcdefghijklmnop"
+	defer b.Close()
+
+	cl := conn.NewHttpClient(conn.Name("test-"), conn.Key(newKey(t)), conn.Broker(b.URL), conn.Token("ponmlkjihgfedcba"))
+	cl.Codec(conn.JsonCodec)
+	if err := cl.Dial(); err == nil {
+		t.Error("Dial succeeded with an invalid token")
+	}
+
+	cl = conn.NewHttpClient(conn.Name("test-"), conn.Key(newKey(t)), conn.Broker(b.URL), conn.Token(b.Token))
+	cl.Codec(conn.JsonCodec)
+	if err := cl.Dial(); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if _, err := b.Accept(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpClient_DialNoFormat(t *testing.T) {
+	b := conntest.NewBroker()
+	b.Formats = []string{conn.MsgpCodec.Format}
+	defer b.Close()
+
+	cl := conn.NewHttpClient(conn.Name("test-"), conn.Key(newKey(t)), conn.Broker(b.URL))
+	cl.Codec(conn.JsonCodec)
+	if err := cl.Dial(); err == nil {
+		t.Error("Dial succeeded without a common format")
+	}
+}
@@ -75,9 +75,10 @@ func NewHttpClient(opts ...func(c *conf)) *httpClient {
 		codecs:    make(map[string]*Encoder),
 	}
 
-	if len(c.token) >= 16 {
-		cl.token = c.token[:16]
-		cl.tHash = cl.keyMaker.HashToken(cl.dsId, cl.token)
+	// The token id is sent with a hash of the dsId and full token, so the secret is never sent.
+	if len(c.token) >= crypto.TokenIdLength {
+		cl.token = c.token[:crypto.TokenIdLength]
+		cl.tHash = cl.keyMaker.HashToken(cl.dsId, c.token)
 	}
 
 	return cl
@@ -140,6 +141,10 @@ func (cl *httpClient) getWsConfig() (*dsResp, error) {
 		return nil, fmt.Errorf("Unable to read response: %s", err)
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("broker refused connection: %s %s", res.Status, strings.TrimSpace(string(b)))
+	}
+
 	dr := &dsResp{}
 	if err = json.Unmarshal(b, dr); err != nil {
 		return nil, fmt.Errorf("Unable to decode response: %s\nError: %s", b, err)
@@ -169,6 +174,7 @@ func (cl *httpClient) connectWs(conf *dsResp) error {
 	if err != nil {
 		return fmt.Errorf("unable to parse websocket url %q, error: %v", conf.WsUri, err)
 	}
+	u = cl.rawUrl.ResolveReference(u) // wsUri is usually relative to the broker address.
 
 	q := u.Query()
 	q.Add("auth", auth)
@@ -178,7 +184,11 @@ func (cl *httpClient) connectWs(conf *dsResp) error {
 		q.Add("token", cl.token+cl.tHash)
 	}
 	u.RawQuery = q.Encode()
-	u.Scheme = "ws"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
 
 	con, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
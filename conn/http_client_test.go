@@ -45,7 +45,7 @@ func TestNewHttpClient(t *testing.T) {
 		t.Errorf("httpClient.token does not match. expected=%q got=%q", tok[:16], cl.token)
 	}
 
-	thash := km.HashToken(dsid, cl.token)
+	thash := km.HashToken(dsid, tok)
 	if thash != cl.tHash {
 		t.Errorf("httpClient.tHash does not match. expected=%q got=%q", thash, cl.tHash)
 	}
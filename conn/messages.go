@@ -0,0 +1,194 @@
+package conn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Request methods.
+const (
+	MethodList        = "list"
+	MethodSubscribe   = "subscribe"
+	MethodUnsubscribe = "unsubscribe"
+	MethodInvoke      = "invoke"
+	MethodSet         = "set"
+	MethodRemove      = "remove"
+	MethodClose       = "close"
+)
+
+// Stream states of a Response.
+const (
+	StreamInitialize = "initialize"
+	StreamOpen       = "open"
+	StreamClosed     = "closed"
+)
+
+// Error types of an Error.
+const (
+	ErrPermissionDenied = "permissionDenied"
+	ErrInvalidMethod    = "invalidMethod"
+	ErrNotImplemented   = "notImplemented"
+	ErrInvalidPath      = "invalidPath"
+	ErrInvalidPaths     = "invalidPaths"
+	ErrInvalidValue     = "invalidValue"
+	ErrInvalidParameter = "invalidParameter"
+	ErrDisconnected     = "disconnected"
+	ErrFailure          = "failure"
+)
+
+// TimeFormat is the layout of timestamps in value updates.
+const TimeFormat = "2006-01-02T15:04:05.000-07:00"
+
+// Message is a single frame sent over a link's websocket connection. A frame with only
+// Msg set is a ping, and is acknowledged like any other frame.
+type Message struct {
+	Msg       int32       `json:"msg,omitempty" msgpack:"msg,omitempty"`
+	Ack       int32       `json:"ack,omitempty" msgpack:"ack,omitempty"`
+	Requests  []*Request  `json:"requests,omitempty" msgpack:"requests,omitempty"`
+	Responses []*Response `json:"responses,omitempty" msgpack:"responses,omitempty"`
+}
+
+// Request is a request from a requester to a responder. Which fields are used depends on Method.
+type Request struct {
+	Rid    int32                  `json:"rid" msgpack:"rid"`
+	Method string                 `json:"method" msgpack:"method"`
+	Path   string                 `json:"path,omitempty" msgpack:"path,omitempty"`
+	Paths  []*SubscribePath       `json:"paths,omitempty" msgpack:"paths,omitempty"`
+	Sids   []int32                `json:"sids,omitempty" msgpack:"sids,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty" msgpack:"params,omitempty"`
+	Value  interface{}            `json:"value,omitempty" msgpack:"value,omitempty"`
+	Permit string                 `json:"permit,omitempty" msgpack:"permit,omitempty"`
+}
+
+// SubscribePath is a single path of a subscribe request.
+type SubscribePath struct {
+	Path string `json:"path" msgpack:"path"`
+	Sid  int32  `json:"sid" msgpack:"sid"`
+	Qos  int    `json:"qos,omitempty" msgpack:"qos,omitempty"`
+}
+
+// Response is a response to the request with the same Rid. Subscription updates are sent
+// in responses with a Rid of 0.
+type Response struct {
+	Rid     int32         `json:"rid" msgpack:"rid"`
+	Stream  string        `json:"stream,omitempty" msgpack:"stream,omitempty"`
+	Updates []interface{} `json:"updates,omitempty" msgpack:"updates,omitempty"`
+	Columns []interface{} `json:"columns,omitempty" msgpack:"columns,omitempty"`
+	Error   *Error        `json:"error,omitempty" msgpack:"error,omitempty"`
+}
+
+// Error is the error of a Response.
+type Error struct {
+	Type   string `json:"type,omitempty" msgpack:"type,omitempty"`
+	Msg    string `json:"msg,omitempty" msgpack:"msg,omitempty"`
+	Phase  string `json:"phase,omitempty" msgpack:"phase,omitempty"`
+	Path   string `json:"path,omitempty" msgpack:"path,omitempty"`
+	Detail string `json:"detail,omitempty" msgpack:"detail,omitempty"`
+}
+
+// NewError returns an Error of type typ with the formatted message.
+func NewError(typ, format string, args ...interface{}) *Error {
+	return &Error{Type: typ, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Msg == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Msg
+}
+
+// ClosedResponse returns a response closing the stream of rid, with an optional error.
+func ClosedResponse(rid int32, err *Error) *Response {
+	return &Response{Rid: rid, Stream: StreamClosed, Error: err}
+}
+
+// CleanPath returns path with a leading slash and without a trailing slash.
+func CleanPath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+// ParentPath returns the path of the parent of path, or "" if path is the root.
+func ParentPath(path string) string {
+	path = CleanPath(path)
+	if path == "/" {
+		return ""
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// JoinPath returns the path of the child named name of path.
+func JoinPath(path, name string) string {
+	path = CleanPath(path)
+	if path == "/" {
+		return "/" + name
+	}
+	return path + "/" + name
+}
+
+// Int32 converts a decoded number to an int32. Numbers are decoded as float64 from json
+// and as various integer types from msgpack.
+func Int32(v interface{}) (int32, bool) {
+	switch n := v.(type) {
+	case int:
+		return int32(n), true
+	case int8:
+		return int32(n), true
+	case int16:
+		return int32(n), true
+	case int32:
+		return n, true
+	case int64:
+		return int32(n), true
+	case uint:
+		return int32(n), true
+	case uint8:
+		return int32(n), true
+	case uint16:
+		return int32(n), true
+	case uint32:
+		return int32(n), true
+	case uint64:
+		return int32(n), true
+	case float32:
+		return int32(n), true
+	case float64:
+		return int32(n), true
+	}
+	return 0, false
+}
+
+// Float64 converts a decoded number to a float64.
+func Float64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessage_Codecs(t *testing.T) {
+	m := &Message{
+		Msg: 3,
+		Requests: []*Request{
+			{Rid: 1, Method: MethodSubscribe, Paths: []*SubscribePath{{Path: "/a", Sid: 2, Qos: 1}}},
+			{Rid: 2, Method: MethodSet, Path: "/b", Value: map[string]interface{}{"c": "d"}},
+		},
+		Responses: []*Response{
+			{Rid: 0, Updates: []interface{}{[]interface{}{"x"}}},
+			ClosedResponse(4, NewError(ErrPermissionDenied, "no %s", "access")),
+		},
+	}
+
+	for _, codec := range []*Encoder{JsonCodec, MsgpCodec} {
+		b, err := codec.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", codec.Format, err)
+		}
+
+		var got Message
+		if err = codec.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: unexpected error: %v", codec.Format, err)
+		}
+
+		if got.Msg != 3 || len(got.Requests) != 2 || len(got.Responses) != 2 {
+			t.Fatalf("%s: unexpected message: %+v", codec.Format, got)
+		}
+		if p := got.Requests[0].Paths[0]; *p != *m.Requests[0].Paths[0] {
+			t.Errorf("%s: subscribe path expected=%+v got=%+v", codec.Format, *m.Requests[0].Paths[0], *p)
+		}
+		if !reflect.DeepEqual(got.Requests[1].Value, map[string]interface{}{"c": "d"}) {
+			t.Errorf("%s: set value unexpected: %#v", codec.Format, got.Requests[1].Value)
+		}
+		if e := got.Responses[1].Error; e == nil || e.Error() != "permissionDenied: no access" {
+			t.Errorf("%s: response error unexpected: %v", codec.Format, e)
+		}
+	}
+}
+
+func TestMessage_Omitted(t *testing.T) {
+	b, _ := JsonCodec.Marshal(&Message{Responses: []*Response{{Rid: 0}}})
+	if string(b) != `{"responses":[{"rid":0}]}` {
+		t.Errorf("Unexpected encoding: %s", b)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	tests := []struct{ path, clean, parent string }{
+		{"", "/", ""},
+		{"/", "/", ""},
+		{"a/b/", "/a/b", "/a"},
+		{"/a", "/a", "/"},
+	}
+	for _, tt := range tests {
+		if got := CleanPath(tt.path); got != tt.clean {
+			t.Errorf("CleanPath(%q) expected=%q got=%q", tt.path, tt.clean, got)
+		}
+		if got := ParentPath(tt.path); got != tt.parent {
+			t.Errorf("ParentPath(%q) expected=%q got=%q", tt.path, tt.parent, got)
+		}
+	}
+
+	if got := JoinPath("/", "a"); got != "/a" {
+		t.Errorf("JoinPath expected=%q got=%q", "/a", got)
+	}
+	if got := JoinPath("/a", "b"); got != "/a/b" {
+		t.Errorf("JoinPath expected=%q got=%q", "/a/b", got)
+	}
+}
+
+func TestInt32(t *testing.T) {
+	for _, v := range []interface{}{int8(5), uint16(5), int64(5), float64(5)} {
+		if n, ok := Int32(v); !ok || n != 5 {
+			t.Errorf("Int32(%T) expected=5 got=%d ok=%v", v, n, ok)
+		}
+	}
+	if _, ok := Int32("5"); ok {
+		t.Error("Int32 of string expected to fail")
+	}
+}
+
+func TestFloat64(t *testing.T) {
+	for _, v := range []interface{}{int8(5), uint32(5), int64(5), float32(5), float64(5)} {
+		if f, ok := Float64(v); !ok || f != 5 {
+			t.Errorf("Float64(%T) expected=5 got=%v ok=%v", v, f, ok)
+		}
+	}
+	if _, ok := Float64("5"); ok {
+		t.Error("Float64 of string expected to fail")
+	}
+}
@@ -0,0 +1,42 @@
+package conn
+
+// Permission is a level of the DSA permission ladder. Each level grants the levels below
+// it, except Never, which is granted to no one.
+type Permission int
+
+// Permission levels, from lowest to highest.
+const (
+	PermissionNone Permission = iota
+	PermissionList
+	PermissionRead
+	PermissionWrite
+	PermissionConfig
+	PermissionNever
+)
+
+var permissionNames = [...]string{"none", "list", "read", "write", "config", "never"}
+
+// ParsePermission returns the Permission named s, such as "write". Returns false if s does
+// not name a permission.
+func ParsePermission(s string) (Permission, bool) {
+	for i, name := range permissionNames {
+		if s == name {
+			return Permission(i), true
+		}
+	}
+	return PermissionNone, false
+}
+
+// String returns the name of p used in $writable, $invokable and permit.
+func (p Permission) String() string {
+	if p < PermissionNone || p > PermissionNever {
+		return "none"
+	}
+	return permissionNames[p]
+}
+
+// Allows reports whether a requester with permission p may perform an operation which
+// requires permission required.
+func (p Permission) Allows(required Permission) bool {
+	return required != PermissionNever && p != PermissionNever && p >= required
+}
@@ -0,0 +1,35 @@
+package conn
+
+import "testing"
+
+func TestParsePermission(t *testing.T) {
+	for _, name := range []string{"none", "list", "read", "write", "config", "never"} {
+		p, ok := ParsePermission(name)
+		if !ok || p.String() != name {
+			t.Errorf("ParsePermission(%q) got=%v %v", name, p, ok)
+		}
+	}
+	if _, ok := ParsePermission("admin"); ok {
+		t.Error("ParsePermission of unknown name returned true")
+	}
+}
+
+func TestPermission_Allows(t *testing.T) {
+	tests := []struct {
+		p, required Permission
+		exp         bool
+	}{
+		{PermissionConfig, PermissionWrite, true},
+		{PermissionWrite, PermissionWrite, true},
+		{PermissionRead, PermissionWrite, false},
+		{PermissionList, PermissionRead, false},
+		{PermissionNone, PermissionNone, true},
+		{PermissionConfig, PermissionNever, false},
+		{PermissionNever, PermissionList, false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Allows(tt.required); got != tt.exp {
+			t.Errorf("%v.Allows(%v) expected=%v got=%v", tt.p, tt.required, tt.exp, got)
+		}
+	}
+}
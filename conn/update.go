@@ -0,0 +1,86 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Statuses of a value.
+const (
+	StatusOk           = "ok"           // the value is current
+	StatusStale        = "stale"        // the value may be out of date
+	StatusDisconnected = "disconnected" // the source of the value is unreachable
+)
+
+// ValueUpdate is a subscription update received by a requester.
+type ValueUpdate struct {
+	Sid   int32
+	Value interface{}
+	Ts    time.Time
+
+	// Status is the status of the value, which is StatusOk unless the responder reports
+	// that the value is stale or its source is disconnected.
+	Status string
+
+	// Count is the number of updates the responder merged into this one, such as while the
+	// link was throttled, or 0 if the update was not merged. When all merged values were
+	// numbers, Sum, Min and Max aggregate them, and otherwise they are nil.
+	Count int
+	Sum   *float64
+	Min   *float64
+	Max   *float64
+}
+
+// ParseValueUpdate parses an update of a subscription Response, which is either a row of
+// [sid, value, ts] or a map with sid, value and ts keys and optional status and aggregation
+// keys.
+func ParseValueUpdate(u interface{}) (ValueUpdate, error) {
+	var vu ValueUpdate
+	var sid, ts interface{}
+
+	switch u := u.(type) {
+	case []interface{}:
+		if len(u) < 2 {
+			return vu, fmt.Errorf("value update %v is too short", u)
+		}
+		sid, vu.Value = u[0], u[1]
+		if len(u) > 2 {
+			ts = u[2]
+		}
+	case map[string]interface{}:
+		sid, vu.Value, ts = u["sid"], u["value"], u["ts"]
+		vu.Status, _ = u["status"].(string)
+		if c, ok := Int32(u["count"]); ok {
+			vu.Count = int(c)
+		}
+		vu.Sum, vu.Min, vu.Max = float64Of(u["sum"]), float64Of(u["min"]), float64Of(u["max"])
+	default:
+		return vu, fmt.Errorf("value update has unexpected type %T", u)
+	}
+
+	if vu.Status == "" {
+		vu.Status = StatusOk
+	}
+
+	var ok bool
+	if vu.Sid, ok = Int32(sid); !ok {
+		return vu, errors.New("value update has no sid")
+	}
+	if s, ok := ts.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return vu, fmt.Errorf("value update has invalid ts %q", s)
+		}
+		vu.Ts = t
+	}
+	return vu, nil
+}
+
+// float64Of returns a pointer to v as a float64, or nil if v is not a number.
+func float64Of(v interface{}) *float64 {
+	if f, ok := Float64(v); ok {
+		return &f
+	}
+	return nil
+}
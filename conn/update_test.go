@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseValueUpdate(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+
+	vu, err := ParseValueUpdate([]interface{}{float64(3), "a", ts.Format(TimeFormat)})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if vu.Sid != 3 || vu.Value != "a" || !vu.Ts.Equal(ts) || vu.Status != StatusOk || vu.Count != 0 {
+		t.Errorf("Unexpected row update: %+v", vu)
+	}
+
+	vu, err = ParseValueUpdate(map[string]interface{}{
+		"sid": int8(4), "value": 2.0, "ts": ts.Format(TimeFormat), "status": StatusStale,
+		"count": uint8(3), "sum": 6.0, "min": int8(1), "max": 3.0,
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if vu.Sid != 4 || vu.Value != 2.0 || !vu.Ts.Equal(ts) || vu.Status != StatusStale || vu.Count != 3 {
+		t.Errorf("Unexpected map update: %+v", vu)
+	}
+	if vu.Sum == nil || vu.Min == nil || vu.Max == nil || *vu.Sum != 6 || *vu.Min != 1 || *vu.Max != 3 {
+		t.Errorf("Map update expected sum=6 min=1 max=3 got=%v %v %v", vu.Sum, vu.Min, vu.Max)
+	}
+
+	// An update of values which were not all numbers has no aggregation, unlike one whose
+	// values sum to zero.
+	vu, err = ParseValueUpdate(map[string]interface{}{"sid": 4, "value": "a", "count": 2})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if vu.Sum != nil || vu.Min != nil || vu.Max != nil {
+		t.Errorf("Expected no aggregation got=%v %v %v", vu.Sum, vu.Min, vu.Max)
+	}
+	vu, _ = ParseValueUpdate(map[string]interface{}{"sid": 4, "value": 0, "count": 2, "sum": 0, "min": -1, "max": 1})
+	if vu.Sum == nil || *vu.Sum != 0 {
+		t.Errorf("Expected sum=0 got=%v", vu.Sum)
+	}
+
+	for _, u := range []interface{}{
+		[]interface{}{1},
+		map[string]interface{}{"value": 1},
+		[]interface{}{1, 2, "yesterday"},
+		"update",
+	} {
+		if _, err = ParseValueUpdate(u); err == nil {
+			t.Errorf("Expected error parsing %v", u)
+		}
+	}
+}
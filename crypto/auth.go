@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// saltSize is the number of random bytes used to generate a handshake salt.
+const saltSize = 16
+
+// TokenIdLength is the length of the token id sent in clear text at the start
+// of the token query parameter.
+const TokenIdLength = 16
+
+// Handshake holds the values a broker generates for each incoming connection
+// and uses to verify the link's "auth" query parameter.
+type Handshake struct {
+	// TempKey is the temporary key pair of the broker for this connection. Its
+	// public key is sent to the link as tempKey.
+	TempKey PrivateKey
+	// Salt is sent to the link and hashed with the shared secret to create the auth.
+	Salt string
+	ecdh ECDH
+}
+
+// NewHandshake generates a new temporary key and salt based on random numbers
+// from io.Reader. Returns an error if it was unable to create either.
+func NewHandshake(rand io.Reader) (*Handshake, error) {
+	ecdh := NewECDH()
+
+	key, err := ecdh.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := NewSalt(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{TempKey: key, Salt: salt, ecdh: ecdh}, nil
+}
+
+// NewSalt creates a new random salt for a connection handshake based on random
+// numbers from io.Reader.
+func NewSalt(rand io.Reader) (string, error) {
+	b := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PublicTempKey returns the Base64 encoded public temporary key to send to the link.
+func (h *Handshake) PublicTempKey() string {
+	return h.TempKey.PublicKey.Base64()
+}
+
+// VerifyAuth confirms that auth was generated from the shared secret of the link's
+// public key and this handshake's temporary key and salt. The comparison is
+// constant time.
+func (h *Handshake) VerifyAuth(linkKey PublicKey, auth string) bool {
+	shared := h.ecdh.GenerateSharedSecret(h.TempKey, linkKey)
+	return VerifyHashSalt(h.ecdh, auth, h.Salt, shared)
+}
+
+// VerifyLink confirms that dsId belongs to linkKey and that auth is valid for this
+// handshake. Returns an error describing which check failed.
+func (h *Handshake) VerifyLink(dsId string, linkKey PublicKey, auth string) error {
+	if !linkKey.VerifyDsId(dsId) {
+		return fmt.Errorf("dsId %q does not match public key", dsId)
+	}
+
+	if !h.VerifyAuth(linkKey, auth) {
+		return errors.New("invalid auth")
+	}
+
+	return nil
+}
+
+// VerifyHashSalt confirms, in constant time, that auth matches the result of e.HashSalt
+// for the provided salt and SharedSecret.
+func VerifyHashSalt(e ECDH, auth, salt string, sec []byte) bool {
+	return constantTimeEqual(auth, e.HashSalt(salt, sec))
+}
+
+// VerifyHashToken confirms, in constant time, that the token query parameter is the
+// token id followed by the result of e.HashToken for dsId and token.
+func VerifyHashToken(e ECDH, param, dsId, token string) bool {
+	if len(token) < TokenIdLength {
+		return false
+	}
+	return constantTimeEqual(param, token[:TokenIdLength]+e.HashToken(dsId, token))
+}
+
+// SplitToken splits the token query parameter into the token id and the token hash.
+// Returns false if the parameter is too short to contain a token id.
+func SplitToken(param string) (id string, hash string, ok bool) {
+	if len(param) <= TokenIdLength {
+		return "", "", false
+	}
+	return param[:TokenIdLength], param[TokenIdLength:], true
+}
+
+// constantTimeEqual compares two strings in constant time.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestNewHandshake(t *testing.T) {
+	h1, err := NewHandshake(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	h2, err := NewHandshake(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if h1.Salt == "" {
+		t.Error("Handshake.Salt should not be empty")
+	}
+	if h1.Salt == h2.Salt {
+		t.Errorf("2 Generated salts match: %v", h1.Salt)
+	}
+	if h1.PublicTempKey() == h2.PublicTempKey() {
+		t.Errorf("2 Generated temp keys match: %v", h1.PublicTempKey())
+	}
+}
+
+func TestHandshake_VerifyAuth(t *testing.T) {
+	ecdh := NewECDH()
+	spriv, _ := ecdh.Unmarshal(serverTempPrivate)
+	cpriv, _ := ecdh.Unmarshal(clientPrivate)
+
+	h := &Handshake{TempKey: spriv, Salt: "0000", ecdh: ecdh}
+	if !h.VerifyAuth(cpriv.PublicKey, hashedAuth) {
+		t.Errorf("VerifyAuth failed for %q", hashedAuth)
+	}
+
+	if h.VerifyAuth(cpriv.PublicKey, hashedAuth[1:]) {
+		t.Error("VerifyAuth accepted an invalid auth")
+	}
+
+	h.Salt = "0001"
+	if h.VerifyAuth(cpriv.PublicKey, hashedAuth) {
+		t.Error("VerifyAuth accepted auth for a different salt")
+	}
+}
+
+func TestHandshake_VerifyLink(t *testing.T) {
+	ecdh := NewECDH()
+	h, err := NewHandshake(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	cpriv, _ := ecdh.Unmarshal(clientPrivate)
+
+	// Link side of the handshake.
+	tmp, _ := ecdh.UnmarshalPublic(h.PublicTempKey())
+	auth := ecdh.HashSalt(h.Salt, ecdh.GenerateSharedSecret(cpriv, tmp))
+
+	if err = h.VerifyLink(clientDsId, cpriv.PublicKey, auth); err != nil {
+		t.Errorf("VerifyLink failed: %v", err)
+	}
+
+	other, _ := ecdh.GenerateKey(rand.Reader)
+	if err = h.VerifyLink(other.DsId("test-"), cpriv.PublicKey, auth); err == nil {
+		t.Error("VerifyLink accepted a dsId for a different key")
+	}
+
+	if err = h.VerifyLink(clientDsId, cpriv.PublicKey, hashedAuth); err == nil {
+		t.Error("VerifyLink accepted an invalid auth")
+	}
+}
+
+func TestSplitToken(t *testing.T) {
+	id, hash, ok := SplitToken("abcdefghijklmnopHASH")
+	if !ok || id != "abcdefghijklmnop" || hash != "HASH" {
+		t.Errorf("SplitToken expected=(%q, %q, true) got=(%q, %q, %v)", "abcdefghijklmnop", "HASH", id, hash, ok)
+	}
+
+	if _, _, ok = SplitToken("abcdefghijklmnop"); ok {
+		t.Error("SplitToken accepted a parameter without a hash")
+	}
+}
+
+func TestVerifyHashSalt(t *testing.T) {
+	ecdh := NewECDH()
+
+	spriv, _ := ecdh.Unmarshal(serverTempPrivate)
+	cpriv, _ := ecdh.Unmarshal(clientPrivate)
+
+	share := ecdh.GenerateSharedSecret(spriv, cpriv.PublicKey)
+	if !VerifyHashSalt(ecdh, hashedAuth, "0000", share) {
+		t.Errorf("VerifyHashSalt failed for %q", hashedAuth)
+	}
+	if VerifyHashSalt(ecdh, hashedAuth, "0001", share) {
+		t.Error("VerifyHashSalt accepted a different salt")
+	}
+}
+
+func TestVerifyHashToken(t *testing.T) {
+	ecdh := NewECDH()
+	tok := "abcdefghijklmnopqrstuvwxyz"
+	param := tok[:16] + ecdh.HashToken(clientDsId, tok)
+
+	if !VerifyHashToken(ecdh, param, clientDsId, tok) {
+		t.Errorf("VerifyHashToken failed for %q", param)
+	}
+	if VerifyHashToken(ecdh, param, "test-other", tok) {
+		t.Error("VerifyHashToken accepted a different dsId")
+	}
+	if VerifyHashToken(ecdh, param, clientDsId, "short") {
+		t.Error("VerifyHashToken accepted a token shorter than the token id")
+	}
+}
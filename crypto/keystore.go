@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// ErrNoKey is returned by a KeyStore when it does not contain a key.
+var ErrNoKey = errors.New("no key in store")
+
+// ErrReadOnly is returned by a KeyStore which cannot save keys.
+var ErrReadOnly = errors.New("key store is read-only")
+
+// KeyStore provides access to a persisted private key, regardless of where it is stored.
+type KeyStore interface {
+	// Load returns the private key held by the store.
+	// Returns ErrNoKey, or an error matching it, if the store does not contain a key.
+	Load() (PrivateKey, error)
+	// Save replaces the private key held by the store.
+	// Returns ErrReadOnly if the store cannot be written to.
+	Save(PrivateKey) error
+	// Exists reports whether the store contains a key. A read-only store, for which a key
+	// cannot be created, returns an error matching ErrNoKey if it does not contain one.
+	Exists() (bool, error)
+}
+
+// LoadOrCreate will load the key from the KeyStore. If the store does not contain
+// a key, a new key is generated and saved to it. A read-only store must already contain
+// a key, so ErrNoKey is returned if it does not.
+// This function returns a PrivateKey or error.
+func LoadOrCreate(ks KeyStore) (PrivateKey, error) {
+	var priv PrivateKey
+
+	ok, err := ks.Exists()
+	if err != nil {
+		return priv, err
+	}
+	if ok {
+		return ks.Load()
+	}
+
+	km := NewECDH()
+	priv, err = km.GenerateKey(rand.Reader)
+	if err != nil {
+		return priv, fmt.Errorf("unable to generate key: %v", err)
+	}
+
+	if err = ks.Save(priv); err == ErrReadOnly {
+		return PrivateKey{}, ErrNoKey
+	}
+	if err != nil {
+		return priv, err
+	}
+
+	log.Info("Generated new key")
+	return priv, nil
+}
+
+// decodeKey will decode a private key in either the DSA key format or PEM.
+func decodeKey(data []byte) (PrivateKey, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("-----BEGIN")) {
+		return UnmarshalPEM(data)
+	}
+
+	km := NewECDH()
+	return km.Unmarshal(string(data))
+}
+
+type fileStore struct {
+	path string
+}
+
+// NewFileStore returns a KeyStore which keeps the key in the DSA key format in the
+// file at path. If no path is specified, it will default to .dslink.key.
+// PEM encoded keys are accepted when loading.
+func NewFileStore(path string) KeyStore {
+	if path == "" {
+		path = defaultKeyFile
+	}
+	return &fileStore{path: path}
+}
+
+func (fs *fileStore) Load() (PrivateKey, error) {
+	var priv PrivateKey
+
+	d, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return priv, ErrNoKey
+	}
+	if err != nil {
+		return priv, fmt.Errorf("Unable to read file: %s\nError: %v", fs.path, err)
+	}
+
+	checkKeyMode(fs.path)
+	return decodeKey(d)
+}
+
+func (fs *fileStore) Save(key PrivateKey) error {
+	return SaveKey(key, fs.path)
+}
+
+func (fs *fileStore) Exists() (bool, error) {
+	_, err := os.Stat(fs.path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+type envStore struct {
+	name string
+}
+
+// NewEnvStore returns a read-only KeyStore which reads the key from the environment
+// variable name. The value may be in the DSA key format or PEM encoded.
+func NewEnvStore(name string) KeyStore {
+	return &envStore{name: name}
+}
+
+func (es *envStore) Load() (PrivateKey, error) {
+	v, ok := os.LookupEnv(es.name)
+	if !ok || strings.TrimSpace(v) == "" {
+		return PrivateKey{}, &missingEnvError{name: es.name}
+	}
+
+	return decodeKey([]byte(v))
+}
+
+func (es *envStore) Save(PrivateKey) error {
+	return ErrReadOnly
+}
+
+func (es *envStore) Exists() (bool, error) {
+	v, ok := os.LookupEnv(es.name)
+	if !ok || strings.TrimSpace(v) == "" {
+		return false, &missingEnvError{name: es.name}
+	}
+	return true, nil
+}
+
+// missingEnvError is ErrNoKey for an env store, naming its variable.
+type missingEnvError struct {
+	name string
+}
+
+func (e *missingEnvError) Error() string {
+	return fmt.Sprintf("%v: environment variable %s is not set", ErrNoKey, e.name)
+}
+
+func (e *missingEnvError) Unwrap() error {
+	return ErrNoKey
+}
+
+type memoryStore struct {
+	mu  sync.Mutex
+	key *PrivateKey
+}
+
+// NewMemoryStore returns a KeyStore which holds the key in memory only. If key is
+// not nil, the store is initialized with it.
+func NewMemoryStore(key *PrivateKey) KeyStore {
+	ms := &memoryStore{}
+	if key != nil {
+		k := *key
+		ms.key = &k
+	}
+	return ms
+}
+
+func (ms *memoryStore) Load() (PrivateKey, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.key == nil {
+		return PrivateKey{}, ErrNoKey
+	}
+	return *ms.key, nil
+}
+
+func (ms *memoryStore) Save(key PrivateKey) error {
+	ms.mu.Lock()
+	ms.key = &key
+	ms.mu.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) Exists() (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.key != nil, nil
+}
@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testEnvKey string = "DSLINK_TEST_KEY"
+
+func TestFileStore(t *testing.T) {
+	ed := NewECDH()
+	file := testKey
+	_ = os.Remove(file)
+	defer os.Remove(file)
+
+	ks := NewFileStore(file)
+	ok, err := ks.Exists()
+	if err != nil || ok {
+		t.Fatalf("Exists on missing file. expected=false got=%v err=%v", ok, err)
+	}
+
+	if _, err = ks.Load(); err != ErrNoKey {
+		t.Errorf("Load on missing file. expected=%v got=%v", ErrNoKey, err)
+	}
+
+	key, _ := ed.GenerateKey(rand.Reader)
+	if err = ks.Save(key); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	ok, _ = ks.Exists()
+	if !ok {
+		t.Error("Exists after Save. expected=true got=false")
+	}
+
+	key2, err := ks.Load()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if key.Base64() != key2.Base64() {
+		t.Error("Saved key and loaded key do not match")
+	}
+}
+
+func TestFileStore_PEM(t *testing.T) {
+	ed := NewECDH()
+	file := testPemKey
+	defer os.Remove(file)
+
+	key, _ := ed.Unmarshal(clientPrivate)
+	if err := SavePEM(key, file); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	key2, err := NewFileStore(file).Load()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if key2.DsId("test-") != clientDsId {
+		t.Errorf("%v != %v", key2.DsId("test-"), clientDsId)
+	}
+}
+
+func TestEnvStore(t *testing.T) {
+	ks := NewEnvStore(testEnvKey)
+	os.Unsetenv(testEnvKey)
+
+	if ok, err := ks.Exists(); ok || !errors.Is(err, ErrNoKey) || !strings.Contains(err.Error(), testEnvKey) {
+		t.Errorf("Exists on unset variable. expected=false, %v naming %s got=%v, %v", ErrNoKey, testEnvKey, ok, err)
+	}
+	if _, err := ks.Load(); !errors.Is(err, ErrNoKey) || !strings.Contains(err.Error(), testEnvKey) {
+		t.Errorf("Load on unset variable. expected=%v naming %s got=%v", ErrNoKey, testEnvKey, err)
+	}
+
+	os.Setenv(testEnvKey, fmt.Sprintf("%s %s\n", clientPrivate, clientPublic))
+	defer os.Unsetenv(testEnvKey)
+
+	key, err := ks.Load()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if key.DsId("test-") != clientDsId {
+		t.Errorf("%v != %v", key.DsId("test-"), clientDsId)
+	}
+
+	if err = ks.Save(key); err != ErrReadOnly {
+		t.Errorf("Save expected=%v got=%v", ErrReadOnly, err)
+	}
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	ks := NewMemoryStore(nil)
+
+	key, err := LoadOrCreate(ks)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	key2, err := LoadOrCreate(ks)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if key.Base64() != key2.Base64() {
+		t.Error("LoadOrCreate generated a second key")
+	}
+
+	_, err = LoadOrCreate(NewEnvStore(testEnvKey))
+	if !errors.Is(err, ErrNoKey) || !strings.Contains(err.Error(), testEnvKey) {
+		t.Errorf("LoadOrCreate on unset variable. expected=%v naming %s got=%v", ErrNoKey, testEnvKey, err)
+	}
+}
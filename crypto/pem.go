@@ -0,0 +1,187 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/butlermatt/dslink/internal/fsutil"
+)
+
+const (
+	pemPKCS8Type = "PRIVATE KEY"
+	pemSEC1Type  = "EC PRIVATE KEY"
+	pemPubType   = "PUBLIC KEY"
+)
+
+// ECDSA returns the crypto/ecdsa representation of this public key.
+func (p PublicKey) ECDSA() *ecdsa.PublicKey {
+	return &ecdsa.PublicKey{Curve: p.Curve, X: p.X, Y: p.Y}
+}
+
+// ECDSA returns the crypto/ecdsa representation of this private key.
+func (p PrivateKey) ECDSA() *ecdsa.PrivateKey {
+	return &ecdsa.PrivateKey{PublicKey: *p.PublicKey.ECDSA(), D: new(big.Int).SetBytes(p.D)}
+}
+
+// FromECDSA converts a crypto/ecdsa private key into a PrivateKey.
+// Returns an error if the key is not on the P-256 curve used by DSA.
+func FromECDSA(key *ecdsa.PrivateKey) (PrivateKey, error) {
+	var priv PrivateKey
+	if key == nil || key.D == nil {
+		return priv, errors.New("ecdsa private key is nil")
+	}
+
+	if key.Curve != elliptic.P256() {
+		return priv, fmt.Errorf("unsupported curve %q, expected P-256", key.Curve.Params().Name)
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if key.D.Sign() < 0 || key.D.BitLen() > size*8 {
+		return priv, fmt.Errorf("private key is out of range for curve %s", key.Curve.Params().Name)
+	}
+	d := key.D.FillBytes(make([]byte, size))
+	if err := validateScalar(key.Curve, d); err != nil {
+		return priv, err
+	}
+
+	x, y := key.Curve.ScalarBaseMult(d)
+	if key.X == nil || key.Y == nil || key.X.Cmp(x) != 0 || key.Y.Cmp(y) != 0 {
+		return priv, errors.New("public key does not match private key")
+	}
+	priv = PrivateKey{PublicKey: PublicKey{Curve: key.Curve, X: key.X, Y: key.Y}, D: d}
+	return priv, nil
+}
+
+// FromECDSAPublic converts a crypto/ecdsa public key into a PublicKey.
+// Returns an error if the key is not on the P-256 curve used by DSA.
+func FromECDSAPublic(key *ecdsa.PublicKey) (PublicKey, error) {
+	var pub PublicKey
+	if key == nil || key.X == nil || key.Y == nil {
+		return pub, errors.New("ecdsa public key is nil")
+	}
+
+	if key.Curve != elliptic.P256() {
+		return pub, fmt.Errorf("unsupported curve %q, expected P-256", key.Curve.Params().Name)
+	}
+
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return pub, errors.New("public key is not a point on the curve")
+	}
+
+	pub = PublicKey{Curve: key.Curve, X: key.X, Y: key.Y}
+	return pub, nil
+}
+
+// MarshalPEM encodes the private key as a PKCS#8 "PRIVATE KEY" PEM block.
+func MarshalPEM(key PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.ECDSA())
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal private key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemPKCS8Type, Bytes: der}), nil
+}
+
+// MarshalPublicPEM encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+func MarshalPublicPEM(key PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.ECDSA())
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal public key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemPubType, Bytes: der}), nil
+}
+
+// UnmarshalPEM decodes the first private key found in data. Both PKCS#8
+// ("PRIVATE KEY") and SEC1 ("EC PRIVATE KEY") blocks are accepted, other
+// blocks such as EC PARAMETERS are skipped.
+// Returns an error if no P-256 private key could be decoded.
+func UnmarshalPEM(data []byte) (PrivateKey, error) {
+	var priv PrivateKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return priv, errors.New("no private key found in PEM data")
+		}
+
+		switch block.Type {
+		case pemPKCS8Type:
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return priv, fmt.Errorf("unable to parse PKCS#8 private key: %v", err)
+			}
+			ek, ok := k.(*ecdsa.PrivateKey)
+			if !ok {
+				return priv, fmt.Errorf("unsupported PKCS#8 key type %T", k)
+			}
+			return FromECDSA(ek)
+		case pemSEC1Type:
+			ek, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return priv, fmt.Errorf("unable to parse EC private key: %v", err)
+			}
+			return FromECDSA(ek)
+		}
+	}
+}
+
+// UnmarshalPublicPEM decodes the first PKIX "PUBLIC KEY" block found in data.
+// Returns an error if no P-256 public key could be decoded.
+func UnmarshalPublicPEM(data []byte) (PublicKey, error) {
+	var pub PublicKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return pub, errors.New("no public key found in PEM data")
+		}
+
+		if block.Type != pemPubType {
+			continue
+		}
+
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return pub, fmt.Errorf("unable to parse public key: %v", err)
+		}
+		ek, ok := k.(*ecdsa.PublicKey)
+		if !ok {
+			return pub, fmt.Errorf("unsupported public key type %T", k)
+		}
+		return FromECDSAPublic(ek)
+	}
+}
+
+// LoadPEM will try to load a PEM encoded private key from the specified file.
+// This function returns a PrivateKey or error.
+func LoadPEM(path string) (PrivateKey, error) {
+	var priv PrivateKey
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return priv, fmt.Errorf("Unable to read file: %s\nError: %v", path, err)
+	}
+
+	return UnmarshalPEM(d)
+}
+
+// SavePEM will attempt to save the specified private key to the specified file
+// as a PKCS#8 PEM block. The file is replaced atomically with mode 0600.
+// This function will return an error on failure.
+func SavePEM(key PrivateKey, path string) error {
+	b, err := MarshalPEM(key)
+	if err != nil {
+		return err
+	}
+
+	return fsutil.WriteFileAtomic(path, b, keyFileMode)
+}
@@ -0,0 +1,142 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+)
+
+const testPemKey string = "test.pem"
+
+func TestPrivateKey_ECDSA(t *testing.T) {
+	ecdh := NewECDH()
+	priv, _ := ecdh.Unmarshal(clientPrivate)
+
+	ek := priv.ECDSA()
+	back, err := FromECDSA(ek)
+	if err != nil {
+		t.Fatalf("FromECDSA failed: %v", err)
+	}
+
+	m1, _ := ecdh.Marshal(priv)
+	m2, _ := ecdh.Marshal(back)
+	if m1 != m2 {
+		t.Errorf("round trip mismatch:\n%s\n%s", m1, m2)
+	}
+}
+
+func TestFromECDSA_WrongCurve(t *testing.T) {
+	ek, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if _, err = FromECDSA(ek); err == nil {
+		t.Error("FromECDSA accepted a P-384 key")
+	}
+}
+
+func TestMarshalPEM(t *testing.T) {
+	ecdh := NewECDH()
+	priv, _ := ecdh.Unmarshal(clientPrivate)
+
+	b, err := MarshalPEM(priv)
+	if err != nil {
+		t.Fatalf("MarshalPEM failed: %v", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("unexpected PEM output: %s", b)
+	}
+
+	priv2, err := UnmarshalPEM(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPEM failed: %v", err)
+	}
+
+	if priv2.DsId("test-") != clientDsId {
+		t.Errorf("%v != %v", priv2.DsId("test-"), clientDsId)
+	}
+}
+
+func TestUnmarshalPEM_SEC1(t *testing.T) {
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	der, err := x509.MarshalECPrivateKey(ek)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	params := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08}})
+	b := append(params, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+
+	priv, err := UnmarshalPEM(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPEM failed: %v", err)
+	}
+
+	if priv.X.Cmp(ek.X) != 0 || priv.Y.Cmp(ek.Y) != 0 {
+		t.Error("public key does not match source key")
+	}
+	if len(priv.D) != 32 {
+		t.Errorf("private key length expected=32 got=%d", len(priv.D))
+	}
+}
+
+func TestUnmarshalPEM_Invalid(t *testing.T) {
+	if _, err := UnmarshalPEM([]byte("not a pem file")); err == nil {
+		t.Error("UnmarshalPEM accepted invalid data")
+	}
+}
+
+func TestMarshalPublicPEM(t *testing.T) {
+	ecdh := NewECDH()
+	pub, _ := ecdh.UnmarshalPublic(clientPublic)
+
+	b, err := MarshalPublicPEM(pub)
+	if err != nil {
+		t.Fatalf("MarshalPublicPEM failed: %v", err)
+	}
+
+	pub2, err := UnmarshalPublicPEM(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPublicPEM failed: %v", err)
+	}
+
+	if pub2.Base64() != clientPublic {
+		t.Errorf("%v != %v", pub2.Base64(), clientPublic)
+	}
+}
+
+func TestSavePEM(t *testing.T) {
+	ed := NewECDH()
+	file := testPemKey
+
+	key, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	err = SavePEM(key, file)
+	if err != nil {
+		t.Fatalf("Error saving file: %s\nError: %v\n", file, err)
+	}
+	defer os.Remove(file)
+
+	key2, err := LoadPEM(file)
+	if err != nil {
+		t.Fatalf("Error loading key from file: %s\nError: %v\n", file, err)
+	}
+
+	cm1, _ := ed.Marshal(key)
+	cm2, _ := ed.Marshal(key2)
+	if cm1 != cm2 {
+		t.Fatal("Saved key and loaded key do not match")
+	}
+}
@@ -79,9 +79,13 @@ func (p PublicKey) DsId(prefix string) string {
 }
 
 // VerifyDsId confirms that the provided dsid matches the expected Hash64 for this
-// public key.
+// public key. The comparison is constant time.
 func (p PublicKey) VerifyDsId(dsid string) bool {
-	return strings.HasSuffix(dsid, p.Hash64())
+	h := p.Hash64()
+	if len(dsid) < len(h) {
+		return false
+	}
+	return constantTimeEqual(dsid[len(dsid)-len(h):], h)
 }
 
 type PrivateKey struct {
@@ -107,25 +111,37 @@ func (e *ellipticECDH) Marshal(priv PrivateKey) (string, error) {
 }
 
 func (e *ellipticECDH) Unmarshal(str string) (PrivateKey, error) {
-	keys := strings.Split(str, " ")
+	keys := strings.Fields(str)
 
 	var priv PrivateKey
 
+	if len(keys) == 0 {
+		return priv, errors.New("no private key to unmarshal")
+	}
+
 	d, err := e.base.DecodeString(keys[0])
 	if err != nil {
+		return priv, fmt.Errorf("unable to decode private key: %v", err)
+	}
+
+	if err = validateScalar(e.Curve, d); err != nil {
 		return priv, err
 	}
 
+	x, y := e.Curve.ScalarBaseMult(d)
+
 	switch len(keys) {
 	case 2:
 		pub, err := e.UnmarshalPublic(keys[1])
 		if err != nil {
 			return priv, err
 		}
+		if pub.X.Cmp(x) != 0 || pub.Y.Cmp(y) != 0 {
+			return priv, errors.New("public key does not match private key")
+		}
 		priv = PrivateKey{PublicKey: PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}, D: d}
 		return priv, nil
 	case 1:
-		x, y := e.Curve.ScalarBaseMult(d)
 		priv = PrivateKey{PublicKey: PublicKey{Curve: e.Curve, X: x, Y: y}, D: d}
 		return priv, nil
 	default:
@@ -139,18 +155,40 @@ func (e *ellipticECDH) UnmarshalPublic(str string) (PublicKey, error) {
 
 	data, err := e.base.DecodeString(str)
 	if err != nil {
-		return pub, err
+		return pub, fmt.Errorf("unable to decode public key: %v", err)
+	}
+
+	size := (e.Curve.Params().BitSize + 7) / 8
+	if len(data) != 1+2*size || data[0] != 4 {
+		return pub, fmt.Errorf("invalid public key length %d, expected %d byte uncompressed point", len(data), 1+2*size)
 	}
 
 	x, y := elliptic.Unmarshal(e.Curve, data)
 	if x == nil || y == nil {
-		return pub, errors.New("unmashaled values are nil")
+		return pub, errors.New("public key is not a point on the curve")
 	}
 
 	pub = PublicKey{Curve: e.Curve, X: x, Y: y}
 	return pub, nil
 }
 
+// validateScalar confirms that d is a valid private key for curve, being no longer
+// than the curve's byte size and in the range [1, N-1].
+func validateScalar(curve elliptic.Curve, d []byte) error {
+	params := curve.Params()
+	size := (params.BitSize + 7) / 8
+	if len(d) == 0 || len(d) > size {
+		return fmt.Errorf("invalid private key length %d, expected at most %d bytes", len(d), size)
+	}
+
+	k := new(big.Int).SetBytes(d)
+	if k.Sign() == 0 || k.Cmp(params.N) >= 0 {
+		return fmt.Errorf("private key is out of range for curve %s", params.Name)
+	}
+
+	return nil
+}
+
 func (e *ellipticECDH) GenerateSharedSecret(priv PrivateKey, pub PublicKey) []byte {
 
 	x, _ := e.Curve.ScalarMult(pub.X, pub.Y, priv.D)
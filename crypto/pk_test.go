@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"testing"
@@ -237,3 +239,71 @@ func TestEllipticECDH_GenerateKey(t *testing.T) {
 		t.Errorf("Failed to generate equal shared secrets:\n%v\n%v", hex.EncodeToString(cshare), hex.EncodeToString(sshare))
 	}
 }
+
+func TestPublicKey_VerifyDsId2(t *testing.T) {
+	ecdh := NewECDH()
+	priv, _ := ecdh.Unmarshal(clientPrivate)
+	if priv.PublicKey.VerifyDsId(clientDsId[:len(clientDsId)-1]) {
+		t.Error("VerifyDsId accepted a truncated dsId")
+	}
+	if priv.PublicKey.VerifyDsId("short") {
+		t.Error("VerifyDsId accepted a dsId shorter than the hash")
+	}
+}
+
+func TestEllipticECDH_UnmarshalInvalid(t *testing.T) {
+	ecdh := NewECDH()
+	zero := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+	n := base64.RawURLEncoding.EncodeToString(elliptic.P256().Params().N.Bytes())
+	long := base64.RawURLEncoding.EncodeToString(make([]byte, 33))
+	spub := serverTempPublic
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"empty", ""},
+		{"bad base64", "!!!!"},
+		{"zero scalar", zero},
+		{"scalar equal to N", n},
+		{"scalar too long", long},
+		{"mismatched pair", fmt.Sprintf("%s %s", clientPrivate, spub)},
+		{"truncated public", fmt.Sprintf("%s %s", clientPrivate, spub[:len(spub)-4])},
+		{"too many sections", fmt.Sprintf("%s %s %s", clientPrivate, clientPublic, clientPublic)},
+	}
+
+	for _, tt := range tests {
+		if _, err := ecdh.Unmarshal(tt.key); err == nil {
+			t.Errorf("%s: Unmarshal accepted invalid key %q", tt.name, tt.key)
+		}
+	}
+}
+
+func TestEllipticECDH_UnmarshalPublicInvalid(t *testing.T) {
+	ecdh := NewECDH()
+
+	pt := make([]byte, 65)
+	pt[0] = 4
+	pt[64] = 1
+	off := base64.RawURLEncoding.EncodeToString(pt)
+
+	if _, err := ecdh.UnmarshalPublic(off); err == nil {
+		t.Error("UnmarshalPublic accepted a point not on the curve")
+	}
+
+	if _, err := ecdh.UnmarshalPublic(clientPublic[:20]); err == nil {
+		t.Error("UnmarshalPublic accepted a truncated key")
+	}
+}
+
+func TestEllipticECDH_UnmarshalTrailingNewline(t *testing.T) {
+	ecdh := NewECDH()
+
+	priv, err := ecdh.Unmarshal(fmt.Sprintf("%s %s\n", clientPrivate, clientPublic))
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if priv.DsId("test-") != clientDsId {
+		t.Errorf("%v != %v", priv.DsId("test-"), clientDsId)
+	}
+}
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/butlermatt/dslink/log"
+)
+
+// backupSuffix is appended to a key file's path to create the path of its backup.
+const backupSuffix = ".bak"
+
+// Rotation is the result of replacing a private key with a newly generated one.
+type Rotation struct {
+	// Old is the private key which was replaced. It has been saved to the backup store.
+	Old PrivateKey
+	// New is the newly generated private key.
+	New PrivateKey
+}
+
+// DsIds returns the dsId of the old and new keys based on the prefix supplied.
+// Both are needed to re-authorize the link on the broker after rotation.
+func (r Rotation) DsIds(prefix string) (old string, new string) {
+	return r.Old.DsId(prefix), r.New.DsId(prefix)
+}
+
+// RotateKey replaces the key held by ks with a new key generated from random
+// numbers from io.Reader. The current key is saved to backup before ks is
+// changed, so a failure never loses the existing key.
+// Returns ErrNoKey if ks does not contain a key to rotate.
+func RotateKey(ks KeyStore, backup KeyStore, rand io.Reader) (Rotation, error) {
+	var rot Rotation
+
+	old, err := ks.Load()
+	if err != nil {
+		return rot, err
+	}
+
+	km := NewECDH()
+	key, err := km.GenerateKey(rand)
+	if err != nil {
+		return rot, fmt.Errorf("unable to generate key: %v", err)
+	}
+
+	if err = backup.Save(old); err != nil {
+		return rot, fmt.Errorf("unable to backup key: %v", err)
+	}
+
+	if err = ks.Save(key); err != nil {
+		return rot, err
+	}
+
+	rot = Rotation{Old: old, New: key}
+	log.Infof("Rotated key, previous key hash %s, new key hash %s", old.Hash64(), key.Hash64())
+	return rot, nil
+}
+
+// BackupFileStore returns a KeyStore for the backup of the key file at path, which is
+// the same path with .bak appended. If no path is specified, it will default to
+// .dslink.key.bak.
+func BackupFileStore(path string) KeyStore {
+	if path == "" {
+		path = defaultKeyFile
+	}
+	return NewFileStore(path + backupSuffix)
+}
+
+// RotateKeyFile replaces the key in the file at path with a newly generated key,
+// keeping the previous key in the file returned by BackupFileStore.
+// If no path is specified, it will default to .dslink.key.
+func RotateKeyFile(path string) (Rotation, error) {
+	return RotateKey(NewFileStore(path), BackupFileStore(path), rand.Reader)
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"os"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	ed := NewECDH()
+	key, _ := ed.Unmarshal(clientPrivate)
+	ks := NewMemoryStore(&key)
+	backup := NewMemoryStore(nil)
+
+	rot, err := RotateKey(ks, backup, rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	old, nw := rot.DsIds("test-")
+	if old != clientDsId {
+		t.Errorf("Rotation old dsId expected=%q got=%q", clientDsId, old)
+	}
+	if nw == clientDsId {
+		t.Error("Rotation new dsId matches old dsId")
+	}
+
+	cur, _ := ks.Load()
+	if cur.DsId("test-") != nw {
+		t.Errorf("KeyStore was not updated. expected=%q got=%q", nw, cur.DsId("test-"))
+	}
+
+	bk, err := backup.Load()
+	if err != nil {
+		t.Fatal("Old key was not saved to backup", err)
+	}
+	if bk.DsId("test-") != clientDsId {
+		t.Errorf("Backup key expected=%q got=%q", clientDsId, bk.DsId("test-"))
+	}
+}
+
+func TestRotateKey_NoKey(t *testing.T) {
+	if _, err := RotateKey(NewMemoryStore(nil), NewMemoryStore(nil), rand.Reader); err != ErrNoKey {
+		t.Errorf("RotateKey on empty store. expected=%v got=%v", ErrNoKey, err)
+	}
+}
+
+func TestRotateKey_BackupFails(t *testing.T) {
+	ed := NewECDH()
+	key, _ := ed.Unmarshal(clientPrivate)
+	ks := NewMemoryStore(&key)
+
+	if _, err := RotateKey(ks, NewEnvStore(testEnvKey), rand.Reader); err == nil {
+		t.Fatal("RotateKey succeeded with a read-only backup")
+	}
+
+	cur, _ := ks.Load()
+	if cur.DsId("test-") != clientDsId {
+		t.Error("Key was replaced even though the backup failed")
+	}
+}
+
+func TestRotateKeyFile(t *testing.T) {
+	file := testKey
+	bak := testKey + backupSuffix
+	defer os.Remove(file)
+	defer os.Remove(bak)
+
+	key, err := LoadOrCreateKey(file)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	rot, err := RotateKeyFile(file)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	bk, err := LoadKey(bak)
+	if err != nil {
+		t.Fatal("Backup file was not created", err)
+	}
+	if bk.Base64() != key.Base64() || rot.Old.Base64() != key.Base64() {
+		t.Error("Backup key does not match original key")
+	}
+
+	cur, _ := LoadKey(file)
+	if cur.Base64() != rot.New.Base64() {
+		t.Error("Key file does not contain the new key")
+	}
+}
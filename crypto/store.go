@@ -3,12 +3,20 @@ package crypto
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+
+	"github.com/butlermatt/dslink/internal/fsutil"
+	"github.com/butlermatt/dslink/log"
 )
 
 const defaultKeyFile string = ".dslink.key"
 
+// keyFileMode is the permission private key files are written with.
+const keyFileMode os.FileMode = 0600
+
 // LoadKey will try to load the public and private key configuration from disk.
 // If no filename is specified, it will default to .dslink.key.
+// A warning is logged if the file is readable by other users.
 // This function returns a PrivateKey or error.
 func LoadKey(path string) (PrivateKey, error) {
 	var priv PrivateKey
@@ -21,12 +29,16 @@ func LoadKey(path string) (PrivateKey, error) {
 		return priv, fmt.Errorf("Unable to read file: %s\nError: %v", path, err)
 	}
 
+	checkKeyMode(path)
+
 	km := NewECDH()
 	return km.Unmarshal(string(d))
 }
 
 // SaveKey will attempt to save the specified private key to the specified file.
 // If path is not specified, then it will use the default .dslink.key.
+// The key is written to a temporary file with mode 0600 which then replaces path,
+// so an existing key is never left partially written.
 // This function will return an error on failure.
 func SaveKey(key PrivateKey, path string) error {
 	km := NewECDH()
@@ -40,5 +52,26 @@ func SaveKey(key PrivateKey, path string) error {
 		return err
 	}
 
-	return ioutil.WriteFile(path, []byte(s), 0644)
+	return fsutil.WriteFileAtomic(path, []byte(s), keyFileMode)
+}
+
+// LoadOrCreateKey will load the key from the specified file. If the file does not
+// exist, a new key is generated and saved to that file.
+// If no filename is specified, it will default to .dslink.key.
+// This function returns a PrivateKey or error.
+func LoadOrCreateKey(path string) (PrivateKey, error) {
+	return LoadOrCreate(NewFileStore(path))
+}
+
+// checkKeyMode logs a warning if the key file at path is readable by anyone
+// other than its owner.
+func checkKeyMode(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	if fi.Mode().Perm()&0004 != 0 {
+		log.Warnf("Key file %q is world-readable (mode %v), it should be %v", path, fi.Mode().Perm(), keyFileMode)
+	}
 }
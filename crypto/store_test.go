@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"crypto/rand"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -125,3 +127,64 @@ func TestLoadKey2(t *testing.T) {
 
 	_ = os.Remove(file)
 }
+
+func TestSaveKey_Mode(t *testing.T) {
+	ed := NewECDH()
+	file := testKey
+
+	key, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// Existing key with loose permissions should be replaced.
+	if err = ioutil.WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer os.Remove(file)
+
+	err = SaveKey(key, file)
+	if err != nil {
+		t.Fatalf("Error saving file: %s\nError: %v\n", file, err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Incorrect file mode. expected=%v got=%v", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	matches, _ := filepath.Glob("." + file + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("Temporary files were not cleaned up: %v", matches)
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	ed := NewECDH()
+	file := testKey
+	_ = os.Remove(file)
+	defer os.Remove(file)
+
+	key, err := LoadOrCreateKey(file)
+	if err != nil {
+		t.Fatalf("Error creating key: %s\nError: %v\n", file, err)
+	}
+
+	if _, err = os.Stat(file); err != nil {
+		t.Fatalf("Expected filename \"%s\" was not created", file)
+	}
+
+	key2, err := LoadOrCreateKey(file)
+	if err != nil {
+		t.Fatalf("Error loading key from file: %s\nError: %v\n", file, err)
+	}
+
+	cm1, _ := ed.Marshal(key)
+	cm2, _ := ed.Marshal(key2)
+	if cm1 != cm2 {
+		t.Fatal("Created key and loaded key do not match")
+	}
+}
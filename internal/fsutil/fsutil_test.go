@@ -0,0 +1,38 @@
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "new" {
+		t.Errorf("File contents expected=%q got=%q", "new", b)
+	}
+	fi, _ := os.Stat(path)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("File mode expected=%v got=%v", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Temporary file left behind: %d entries", len(entries))
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "file"), nil, 0600); err == nil {
+		t.Error("Expected error writing to missing directory")
+	}
+}
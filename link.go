@@ -1,4 +1,178 @@
 package dslink
 
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/butlermatt/dslink/node"
+)
+
+// Link is a DSLink which connects to a broker as a requester, responder or both.
 type Link struct {
+	name   string
+	keys   crypto.KeyStore
+	backup crypto.KeyStore
+	key    *crypto.PrivateKey
+
+	nodes     *node.Tree
+	nodesFile string
+	saver     *node.Saver
+}
+
+// New creates a new Link with the specified name. Options may be passed to further
+// configure the Link. By default the private key is stored in .dslink.key and
+// is backed up to .dslink.key.bak when rotated, and nodes are saved to nodes.json.
+func New(name string, opts ...func(l *Link)) *Link {
+	l := &Link{name: name, nodes: node.NewTree(), nodesFile: node.DefaultNodesFile}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.keys == nil {
+		l.keys = crypto.NewFileStore("")
+		if l.backup == nil {
+			l.backup = crypto.BackupFileStore("")
+		}
+	}
+
+	return l
+}
+
+// KeyStore sets the store the Link loads its private key from. If the store does
+// not contain a key, one will be generated and saved to it.
+func KeyStore(ks crypto.KeyStore) func(l *Link) {
+	return func(l *Link) {
+		l.keys = ks
+	}
+}
+
+// KeyBackup sets the store the previous private key is saved to when the key is
+// rotated.
+func KeyBackup(ks crypto.KeyStore) func(l *Link) {
+	return func(l *Link) {
+		l.backup = ks
+	}
+}
+
+// NodesFile sets the file the node tree is restored from and saved to, which other
+// DSA SDKs set with the --nodes argument.
+func NodesFile(path string) func(l *Link) {
+	return func(l *Link) {
+		l.nodesFile = path
+	}
+}
+
+// Profile registers the profile name with the Link. See AddProfile.
+func Profile(name string, p node.Profile) func(l *Link) {
+	return func(l *Link) {
+		l.AddProfile(name, p)
+	}
+}
+
+// Name returns the name of the link, which is used as the prefix of its dsId.
+func (l *Link) Name() string {
+	return l.name
+}
+
+// Key returns the private key of the link, loading or creating it from the
+// KeyStore on first use.
+func (l *Link) Key() (*crypto.PrivateKey, error) {
+	if l.key != nil {
+		return l.key, nil
+	}
+
+	key, err := crypto.LoadOrCreate(l.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	l.key = &key
+	return l.key, nil
+}
+
+// DsId returns the dsId of the link based on its name and private key.
+func (l *Link) DsId() (string, error) {
+	key, err := l.Key()
+	if err != nil {
+		return "", err
+	}
+
+	return key.DsId(l.name), nil
+}
+
+// RotateKey replaces the private key of the link with a newly generated key, saving
+// the previous key to the backup store. The returned Rotation reports both dsIds so
+// the new dsId can be authorized on the broker. The link must reconnect to use the
+// new key.
+func (l *Link) RotateKey() (crypto.Rotation, error) {
+	if l.backup == nil {
+		return crypto.Rotation{}, errors.New("no key backup store configured")
+	}
+
+	if _, err := l.Key(); err != nil {
+		return crypto.Rotation{}, err
+	}
+
+	rot, err := crypto.RotateKey(l.keys, l.backup, rand.Reader)
+	if err != nil {
+		return rot, err
+	}
+
+	l.key = &rot.New
+	return rot, nil
+}
+
+// PreviousDsId returns the dsId of the key held in the backup store, which is the
+// key in use before the last rotation. Returns crypto.ErrNoKey if there is no backup.
+func (l *Link) PreviousDsId() (string, error) {
+	if l.backup == nil {
+		return "", crypto.ErrNoKey
+	}
+
+	key, err := l.backup.Load()
+	if err != nil {
+		return "", err
+	}
+
+	return key.DsId(l.name), nil
+}
+
+// AddProfile registers the constructor p for nodes whose $is config is name. Nodes created
+// with node.Is(name), such as by an action which adds a device, are initialized by p and
+// advertise name as their $is. When the nodes are restored by LoadNodes, p rebuilds them.
+func (l *Link) AddProfile(name string, p node.Profile) {
+	l.nodes.AddProfile(name, p)
+}
+
+// Nodes returns the node tree of the link.
+func (l *Link) Nodes() *node.Tree {
+	return l.nodes
+}
+
+// LoadNodes restores the node tree from the nodes file, and then saves the tree back to
+// the file whenever it changes. Profiles should be added before calling LoadNodes.
+func (l *Link) LoadNodes() error {
+	if l.saver != nil {
+		return errors.New("nodes have already been loaded")
+	}
+
+	if err := l.nodes.LoadFile(l.nodesFile); err != nil {
+		return err
+	}
+
+	l.saver = node.NewSaver(l.nodes, l.nodesFile)
+	return nil
+}
+
+// Close saves any unsaved changes to the node tree.
+func (l *Link) Close() error {
+	if l.saver == nil {
+		return nil
+	}
+
+	err := l.saver.Close()
+	l.saver = nil
+	return err
 }
@@ -0,0 +1,183 @@
+package dslink
+
+import (
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/butlermatt/dslink/crypto"
+	"github.com/butlermatt/dslink/node"
+)
+
+func TestNew(t *testing.T) {
+	l := New("test-")
+
+	if l.Name() != "test-" {
+		t.Errorf("Link.name expected=%q got=%q", "test-", l.Name())
+	}
+
+	if l.keys == nil {
+		t.Error("Link.keys should have a default KeyStore")
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	km := crypto.NewECDH()
+	key, err := km.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key for test", err)
+	}
+
+	ks := crypto.NewMemoryStore(&key)
+	l := New("test-", KeyStore(ks))
+
+	lk, err := l.Key()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if lk.Base64() != key.Base64() {
+		t.Errorf("Link key does not match store. expected=%q got=%q", key.Base64(), lk.Base64())
+	}
+
+	id, err := l.DsId()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if id != key.DsId("test-") {
+		t.Errorf("Link.DsId expected=%q got=%q", key.DsId("test-"), id)
+	}
+}
+
+func TestLink_KeyGenerated(t *testing.T) {
+	ks := crypto.NewMemoryStore(nil)
+	l := New("test-", KeyStore(ks))
+
+	lk, err := l.Key()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	sk, err := ks.Load()
+	if err != nil {
+		t.Fatal("Generated key was not saved to store", err)
+	}
+	if lk.Base64() != sk.Base64() {
+		t.Error("Generated key does not match stored key")
+	}
+}
+
+func TestLink_RotateKey(t *testing.T) {
+	ks := crypto.NewMemoryStore(nil)
+	backup := crypto.NewMemoryStore(nil)
+	l := New("test-", KeyStore(ks), KeyBackup(backup))
+
+	if _, err := l.PreviousDsId(); err != crypto.ErrNoKey {
+		t.Errorf("PreviousDsId without backup. expected=%v got=%v", crypto.ErrNoKey, err)
+	}
+
+	before, err := l.DsId()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	rot, err := l.RotateKey()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	old, nw := rot.DsIds("test-")
+	if old != before {
+		t.Errorf("Rotation old dsId expected=%q got=%q", before, old)
+	}
+
+	after, _ := l.DsId()
+	if after != nw {
+		t.Errorf("Link.DsId after rotation expected=%q got=%q", nw, after)
+	}
+
+	prev, err := l.PreviousDsId()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if prev != before {
+		t.Errorf("Link.PreviousDsId expected=%q got=%q", before, prev)
+	}
+}
+
+func TestLink_RotateKeyNoBackup(t *testing.T) {
+	l := New("test-", KeyStore(crypto.NewMemoryStore(nil)))
+
+	if _, err := l.RotateKey(); err == nil {
+		t.Error("RotateKey succeeded without a backup store")
+	}
+}
+
+// deviceProfile builds a device node with a value and a remove action.
+func deviceProfile(n *node.Node) {
+	if n.Child("temp") == nil {
+		_, _ = n.CreateChild("temp", node.Type("number"), node.Value(0))
+	}
+	if n.Child("remove") == nil {
+		_, _ = n.CreateChild("remove", node.Transient, node.OnInvoke(func(a *node.Node, _ map[string]interface{}) ([][]interface{}, error) {
+			a.Parent().Remove()
+			return nil, nil
+		}))
+	}
+}
+
+func addDevice(l *Link) {
+	_, _ = l.Nodes().Root().CreateChild("add", node.Transient, node.OnInvoke(func(_ *node.Node, params map[string]interface{}) ([][]interface{}, error) {
+		name, _ := params["name"].(string)
+		_, err := l.Nodes().Root().CreateChild(name, node.Is("device"))
+		return nil, err
+	}))
+}
+
+func TestLink_Profiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	l := New("test-", KeyStore(crypto.NewMemoryStore(nil)), NodesFile(path), Profile("device", deviceProfile))
+	addDevice(l)
+	if err := l.LoadNodes(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := l.LoadNodes(); err == nil {
+		t.Error("Expected error loading nodes twice")
+	}
+
+	if _, err := l.Nodes().Get("/add").Invoke(map[string]interface{}{"name": "pump"}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	pump := l.Nodes().Get("/pump")
+	if pump == nil || pump.Profile() != "device" || pump.Child("temp") == nil {
+		t.Fatal("Device was not created by its profile")
+	}
+	pump.Child("temp").SetValue(42.0)
+	if err := l.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// A new link rebuilds the device, including its action, from nodes.json.
+	l = New("test-", KeyStore(crypto.NewMemoryStore(nil)), NodesFile(path))
+	l.AddProfile("device", deviceProfile)
+	if err := l.LoadNodes(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer l.Close()
+
+	pump = l.Nodes().Get("/pump")
+	if pump == nil || pump.Profile() != "device" {
+		t.Fatal("Device was not restored")
+	}
+	if v, _ := pump.Child("temp").Value(); v != 42.0 {
+		t.Errorf("Restored value expected=42 got=%v", v)
+	}
+	if l.Nodes().Get("/add") != nil {
+		t.Error("Transient node was restored")
+	}
+	if _, err := pump.Child("remove").Invoke(nil); err != nil {
+		t.Fatal("Restored action failed", err)
+	}
+	if l.Nodes().Get("/pump") != nil {
+		t.Error("Restored remove action did not remove device")
+	}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// maxStackDepth is the maximum number of frames included in a stack trace.
+const maxStackDepth = 64
+
+var (
+	callerEnabled int32
+	stackLevel    = int32(DisabledLvl)
+)
+
+// SetCaller enables or disables recording the file and line which created each log entry.
+func SetCaller(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&callerEnabled, v)
+}
+
+// SetStackLevel sets the level at or above which a stack trace is recorded with each log entry. The caller is
+// always recorded when a stack trace is. The default is DisabledLvl, which never records a stack trace.
+func SetStackLevel(lvl Level) {
+	atomic.StoreInt32(&stackLevel, int32(lvl))
+}
+
+// addCaller records the caller and stack trace of the record, if enabled, skipping the specified number of
+// stack frames, where 0 is the caller of addCaller.
+func addCaller(r *Record, skip int) {
+	stack := r.Level >= Level(atomic.LoadInt32(&stackLevel))
+	if !stack && atomic.LoadInt32(&callerEnabled) == 0 {
+		return
+	}
+
+	depth := 1
+	if stack {
+		depth = maxStackDepth
+	}
+	pcs := make([]uintptr, depth)
+	n := runtime.Callers(skip+2, pcs)
+	if n == 0 {
+		return
+	}
+
+	setCaller(r, pcs[:n], stack)
+}
+
+// callerPC returns the program counter of a caller, skipping the specified number of stack frames, where 0 is
+// the caller of callerPC.
+func callerPC(skip int) uintptr {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return 0
+	}
+	return pcs[0]
+}
+
+// setCaller records the caller from the first program counter in pcs, and the stack trace from all of them
+// if stack is true.
+func setCaller(r *Record, pcs []uintptr, stack bool) {
+	frames := runtime.CallersFrames(pcs)
+
+	var buf strings.Builder
+	first := true
+	for {
+		f, more := frames.Next()
+		if first {
+			r.Caller = fmt.Sprintf("%s:%d", shortFile(f.File), f.Line)
+			first = false
+		}
+		if !stack {
+			break
+		}
+		fmt.Fprintf(&buf, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+
+	r.Stack = buf.String()
+}
+
+// shortFile returns the file name and its directory, such as "conn/http_client.go".
+func shortFile(file string) string {
+	dir, name := path.Split(file)
+	return path.Base(dir) + "/" + name
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// line returns the line number of its caller.
+func line() int {
+	_, _, l, _ := runtime.Caller(1)
+	return l
+}
+
+func TestSetCaller(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	SetCaller(true)
+	defer SetOutput(os.Stdout)
+	defer SetCaller(false)
+
+	l := New("Caller")
+	l.SetLevel(TraceLvl)
+
+	want := line() + 1
+	l.Info("method")
+	Flush()
+	if s := buf.String(); !strings.Contains(s, "log/caller_test.go:"+strconv.Itoa(want)+": method") {
+		t.Errorf("Logged line does not contain caller line %d: %q", want, s)
+	}
+
+	buf.Reset()
+	want = line() + 1
+	l.Logf(InfoLvl, "logf")
+	Flush()
+	if s := buf.String(); !strings.Contains(s, "log/caller_test.go:"+strconv.Itoa(want)+": logf") {
+		t.Errorf("Logged line does not contain caller line %d: %q", want, s)
+	}
+
+	buf.Reset()
+	orig := rootLogger.Level()
+	SetLevel(TraceLvl)
+	want = line() + 1
+	Infof("root %d", 1)
+	SetLevel(orig)
+	Flush()
+	if s := buf.String(); !strings.Contains(s, "log/caller_test.go:"+strconv.Itoa(want)+": root 1") {
+		t.Errorf("Logged line does not contain caller line %d: %q", want, s)
+	}
+}
+
+func TestSetStackLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	SetFormatter(JSONFormatter{})
+	SetStackLevel(ErrorLvl)
+	defer SetOutput(os.Stdout)
+	defer SetFormatter(TextFormatter{})
+	defer SetStackLevel(DisabledLvl)
+
+	l := New("Stack")
+	l.SetLevel(TraceLvl)
+	l.Warn("no stack")
+	l.Error("with stack")
+	Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Logged lines expected=2 got=%d: %q", len(lines), buf.String())
+	}
+
+	var m map[string]interface{}
+	_ = json.Unmarshal([]byte(lines[0]), &m)
+	if _, ok := m["stack"]; ok {
+		t.Errorf("Stack recorded below stack level: %q", lines[0])
+	}
+	if _, ok := m["caller"]; ok {
+		t.Errorf("Caller recorded while disabled: %q", lines[0])
+	}
+
+	m = nil
+	_ = json.Unmarshal([]byte(lines[1]), &m)
+	st, _ := m["stack"].(string)
+	if !strings.Contains(st, "log.TestSetStackLevel") {
+		t.Errorf("Stack does not contain test function: %q", st)
+	}
+	if strings.Contains(st, "log.(*Logger).log") {
+		t.Errorf("Stack contains logging frames: %q", st)
+	}
+	if c, _ := m["caller"].(string); !strings.HasPrefix(c, "log/caller_test.go:") {
+		t.Errorf("Caller expected=%q got=%q", "log/caller_test.go:", c)
+	}
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (cb *closeBuffer) Close() error {
+	cb.closed = true
+	return nil
+}
+
+func TestFlush(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	defer SetOutput(os.Stdout)
+
+	l := New("Flush")
+	l.SetLevel(TraceLvl)
+	for i := 0; i < 25; i++ {
+		l.Infof("line %d", i)
+	}
+	Flush()
+
+	s := buf.String()
+	if n := strings.Count(s, "\n"); n != 25 {
+		t.Errorf("Flushed lines expected=25 got=%d", n)
+	}
+	if !strings.Contains(s, "line 24") {
+		t.Errorf("Last line was not flushed: %q", s)
+	}
+}
+
+func TestClose(t *testing.T) {
+	out := new(closeBuffer)
+	sink := new(closeBuffer)
+	s := NewWriterSink(sink, TraceLvl, nil)
+	SetOutput(out)
+	AddSink(s)
+	defer RemoveSink(s)
+	defer SetOutput(os.Stdout)
+
+	l := New("Close")
+	l.SetLevel(TraceLvl)
+	l.Info("before close")
+	Close()
+
+	if !out.closed || !sink.closed {
+		t.Errorf("Writers were not closed. output=%v sink=%v", out.closed, sink.closed)
+	}
+	if !strings.Contains(out.String(), "before close") || !strings.Contains(sink.String(), "before close") {
+		t.Errorf("Queued entry was not written before close. output=%q sink=%q", out.String(), sink.String())
+	}
+
+	l.Info("after close")
+	Flush()
+	if strings.Contains(out.String(), "after close") {
+		t.Error("Entry logged after Close was written")
+	}
+
+	// Setting an output restarts logging.
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	l.Info("restarted")
+	Flush()
+	if !strings.Contains(buf.String(), "restarted") {
+		t.Errorf("Entry logged after restart was not written: %q", buf.String())
+	}
+}
+
+func TestSetFatalExit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	SetFatalExit(true)
+
+	code := -1
+	exit = func(c int) { code = c }
+	defer func() {
+		exit = os.Exit
+		SetFatalExit(false)
+		SetOutput(os.Stdout)
+	}()
+
+	l := New("Fatal")
+	l.SetLevel(TraceLvl)
+	l.Fatal("crash")
+
+	if code != 1 {
+		t.Errorf("Exit code expected=1 got=%d", code)
+	}
+	if !strings.Contains(buf.String(), "crash") {
+		t.Errorf("Fatal entry was not written before exit: %q", buf.String())
+	}
+}
+
+func TestSetFatalExit_Filtered(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	SetFatalExit(true)
+
+	code := -1
+	exit = func(c int) { code = c }
+	defer func() {
+		exit = os.Exit
+		SetFatalExit(false)
+		SetOutput(os.Stdout)
+	}()
+
+	queued := New("Queued")
+	queued.SetLevel(TraceLvl)
+	queued.Info("queued")
+
+	l := New("Disabled")
+	l.SetLevel(DisabledLvl)
+	l.Fatal("filtered")
+
+	if code != 1 {
+		t.Errorf("Exit code of filtered Fatal expected=1 got=%d", code)
+	}
+	if !strings.Contains(buf.String(), "queued") || strings.Contains(buf.String(), "filtered") {
+		t.Errorf("Unexpected output before exit: %q", buf.String())
+	}
+
+	// Fatal also exits once the log is closed.
+	code = -1
+	l.SetLevel(TraceLvl)
+	l.Fatal("closed")
+	if code != 1 {
+		t.Errorf("Exit code of Fatal after Close expected=1 got=%d", code)
+	}
+}
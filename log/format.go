@@ -0,0 +1,110 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Formatter converts a Record into the bytes written to a log output. Each call should
+// return a single complete entry, including the trailing newline.
+type Formatter interface {
+	Format(r *Record) []byte
+}
+
+// TextFormatter formats records as "[time] LEVEL [name] message key=value". This is the
+// default Formatter.
+type TextFormatter struct{}
+
+// Format returns the text representation of the Record followed by a newline.
+func (TextFormatter) Format(r *Record) []byte {
+	return append(r.Bytes(), '\n')
+}
+
+// JSONFormatter formats records as a single line JSON object per record, suitable for
+// JSON-lines log collectors. Fields are added as members of the object. A field which
+// would replace one of the standard keys is prefixed with "fields.".
+type JSONFormatter struct{}
+
+// Format returns the JSON representation of the Record followed by a newline.
+func (JSONFormatter) Format(r *Record) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	writeJSONMember(&buf, "time", r.Time.Format(time.RFC3339Nano), false)
+	writeJSONMember(&buf, "level", r.Level.name(), true)
+	writeJSONMember(&buf, "logger", r.LoggerName, true)
+	writeJSONMember(&buf, "msg", r.Message(), true)
+	if r.Caller != "" {
+		writeJSONMember(&buf, "caller", r.Caller, true)
+	}
+	if r.Stack != "" {
+		writeJSONMember(&buf, "stack", r.Stack, true)
+	}
+	for _, f := range r.Fields {
+		k := f.Key
+		if reservedKey(k) {
+			k = "fields." + k
+		}
+		writeJSONMember(&buf, k, f.Value, true)
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+func writeJSONMember(buf *bytes.Buffer, key string, value interface{}, sep bool) {
+	if sep {
+		buf.WriteByte(',')
+	}
+
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(v)
+}
+
+// LogfmtFormatter formats records as logfmt key=value pairs, one record per line.
+// A field which would replace one of the standard keys is prefixed with "fields.".
+type LogfmtFormatter struct{}
+
+// Format returns the logfmt representation of the Record followed by a newline.
+func (LogfmtFormatter) Format(r *Record) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("time=" + r.Time.Format(time.RFC3339Nano))
+	buf.WriteString(" level=" + strings.ToLower(r.Level.name()))
+	buf.WriteString(" logger=" + quoteValue(r.LoggerName))
+	buf.WriteString(" msg=" + quoteValue(r.Message()))
+	if r.Caller != "" {
+		buf.WriteString(" caller=" + quoteValue(r.Caller))
+	}
+	if r.Stack != "" {
+		buf.WriteString(" stack=" + quoteValue(r.Stack))
+	}
+	for _, f := range r.Fields {
+		if reservedKey(f.Key) {
+			f.Key = "fields." + f.Key
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(f.String())
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+func reservedKey(k string) bool {
+	switch k {
+	case "time", "level", "logger", "msg", "caller", "stack":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord() *Record {
+	r := newRecord(InfoLvl, "DSA.Test", "value is %d", []Field{F("path", "/a b"), F("msg", "dup")}, 5)
+	r.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	return r
+}
+
+func TestTextFormatter(t *testing.T) {
+	b := string(TextFormatter{}.Format(testRecord()))
+
+	want := "[2020-01-02 03:04:05.000] INFO  [DSA.Test] value is 5 path=\"/a b\" msg=dup\n"
+	if b != want {
+		t.Errorf("TextFormatter expected=%q got=%q", want, b)
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	b := JSONFormatter{}.Format(testRecord())
+
+	if !strings.HasSuffix(string(b), "}\n") || strings.Count(string(b), "\n") != 1 {
+		t.Errorf("JSONFormatter output is not a single line: %q", b)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("JSONFormatter output is not valid JSON: %v\n%s", err, b)
+	}
+
+	want := map[string]interface{}{
+		"time":       "2020-01-02T03:04:05Z",
+		"level":      "INFO",
+		"logger":     "DSA.Test",
+		"msg":        "value is 5",
+		"path":       "/a b",
+		"fields.msg": "dup",
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("JSONFormatter key %q expected=%v got=%v", k, v, m[k])
+		}
+	}
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	b := string(LogfmtFormatter{}.Format(testRecord()))
+
+	want := "time=2020-01-02T03:04:05Z level=info logger=DSA.Test msg=\"value is 5\" path=\"/a b\" fields.msg=dup\n"
+	if b != want {
+		t.Errorf("LogfmtFormatter expected=%q got=%q", want, b)
+	}
+}
+
+func TestSetFormatter(t *testing.T) {
+	buf := newWriter()
+	SetOutput(buf)
+	defer SetOutput(os.Stdout)
+	SetFormatter(JSONFormatter{})
+	defer SetFormatter(TextFormatter{})
+
+	Warn("json output")
+	<-buf.ch
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.buf.Bytes(), &m); err != nil {
+		t.Fatalf("Logged line is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if m["msg"] != "json output" {
+		t.Errorf("Logged message expected=%q got=%v", "json output", m["msg"])
+	}
+}
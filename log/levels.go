@@ -0,0 +1,169 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	lvlMu sync.RWMutex
+	// rules maps a logger name to the level of that logger and its descendants. The key "*"
+	// applies to all loggers.
+	rules map[string]Level
+)
+
+// ruleName converts a rule pattern into the logger name it applies to.
+func ruleName(pattern string) string {
+	if pattern == "*" {
+		return pattern
+	}
+	return strings.TrimSuffix(pattern, ".*")
+}
+
+// effectiveLevel must be called with lvlMu held. The level of the default logger is only used when no
+// other level or rule applies.
+func (l *Logger) effectiveLevel() Level {
+	lg := l
+	for {
+		if lg.levelSet && lg.parent != nil {
+			return lg.level
+		}
+		if lvl, ok := rules[lg.name]; ok {
+			return lvl
+		}
+		if lg.parent == nil {
+			break
+		}
+		lg = lg.parent
+	}
+
+	if lvl, ok := rules["*"]; ok {
+		return lvl
+	}
+	return lg.level
+}
+
+// SetLevelRule sets the level of the logger with the name matched by pattern and all of its descendants,
+// including existing loggers. A pattern may be a logger name, such as "DSA.conn", optionally followed
+// by ".*", or "*" which matches all loggers. The level of the closest logger, walking up from a logger
+// through its parents, which has either a level set with SetLevel or a matching rule is used. The "*"
+// rule is only used when no other rule or level applies, taking precedence over the default logger's level.
+func SetLevelRule(pattern string, level Level) {
+	lvlMu.Lock()
+	if rules == nil {
+		rules = make(map[string]Level)
+	}
+	rules[ruleName(pattern)] = level
+	lvlMu.Unlock()
+}
+
+// ClearLevelRules removes all rules added with SetLevelRule.
+func ClearLevelRules() {
+	lvlMu.Lock()
+	rules = nil
+	lvlMu.Unlock()
+}
+
+// ParseLevel converts the name of a level, such as "info" or "TRACE", into a Level. "none", "off" and
+// "disabled" are accepted for DisabledLvl.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace", "all":
+		return TraceLvl, nil
+	case "debug":
+		return DebugLvl, nil
+	case "fine":
+		return FineLvl, nil
+	case "warn", "warning":
+		return WarningLvl, nil
+	case "info":
+		return InfoLvl, nil
+	case "error":
+		return ErrorLvl, nil
+	case "admin":
+		return AdminLvl, nil
+	case "fatal":
+		return FatalLvl, nil
+	case "none", "off", "disabled":
+		return DisabledLvl, nil
+	default:
+		return DisabledLvl, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// SetLevels configures log levels from a comma separated specification, as passed to the --log argument.
+// A plain level sets the level of the default logger, pattern=level entries set level rules, replacing
+// any existing rules. For example: "info,DSA.conn.*=trace".
+// Returns an error, without changing any levels, if the specification cannot be parsed.
+func SetLevels(spec string) error {
+	var root *Level
+	rs := make(map[string]Level)
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.Index(part, "=")
+		if i < 0 {
+			lvl, err := ParseLevel(part)
+			if err != nil {
+				return err
+			}
+			root = &lvl
+			continue
+		}
+
+		pattern := strings.TrimSpace(part[:i])
+		if pattern == "" {
+			return fmt.Errorf("missing logger name in %q", part)
+		}
+		lvl, err := ParseLevel(part[i+1:])
+		if err != nil {
+			return err
+		}
+		rs[pattern] = lvl
+	}
+
+	ClearLevelRules()
+	for pattern, lvl := range rs {
+		SetLevelRule(pattern, lvl)
+	}
+	if root != nil {
+		SetLevel(*root)
+	}
+
+	return nil
+}
+
+// SetLevelsFromJSON configures log levels from the "log" config of a dslink.json file. The value, or the
+// default if no value is set, is parsed as with SetLevels. If the file has no log config, levels are
+// not changed.
+func SetLevelsFromJSON(data []byte) error {
+	var dj struct {
+		Configs struct {
+			Log *struct {
+				Value   *string `json:"value"`
+				Default *string `json:"default"`
+			} `json:"log"`
+		} `json:"configs"`
+	}
+
+	if err := json.Unmarshal(data, &dj); err != nil {
+		return fmt.Errorf("unable to decode dslink.json: %v", err)
+	}
+
+	lc := dj.Configs.Log
+	switch {
+	case lc == nil:
+		return nil
+	case lc.Value != nil:
+		return SetLevels(*lc.Value)
+	case lc.Default != nil:
+		return SetLevels(*lc.Default)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"testing"
+)
+
+func TestChild_DynamicLevel(t *testing.T) {
+	p := New("Dyn")
+	p.SetLevel(ErrorLvl)
+	c := p.Child("Child")
+	w := c.With(F("a", 1))
+
+	if c.Level() != ErrorLvl || w.Level() != ErrorLvl {
+		t.Errorf("Inherited level expected=%v got=%v, %v", ErrorLvl, c.Level(), w.Level())
+	}
+
+	p.SetLevel(TraceLvl)
+	if c.Level() != TraceLvl || w.Level() != TraceLvl {
+		t.Errorf("Level change did not reach children. expected=%v got=%v, %v", TraceLvl, c.Level(), w.Level())
+	}
+
+	c.SetLevel(InfoLvl)
+	if c.Level() != InfoLvl || w.Level() != InfoLvl {
+		t.Errorf("Explicit child level expected=%v got=%v, %v", InfoLvl, c.Level(), w.Level())
+	}
+}
+
+func TestSetLevelRule(t *testing.T) {
+	defer ClearLevelRules()
+
+	p := New("Rules")
+	p.SetLevel(ErrorLvl)
+	conn := New("conn")
+	http := conn.Child("http")
+	other := New("connection")
+
+	SetLevelRule("DSA.conn.*", TraceLvl)
+	SetLevelRule("DSA.conn.http", FineLvl)
+
+	tests := []struct {
+		l    *Logger
+		want Level
+	}{
+		{conn, TraceLvl},
+		{http, FineLvl},
+		{http.Child("ws"), FineLvl},
+		{conn.Child("tcp"), TraceLvl},
+		{other, rootLogger.Level()},
+		{p, ErrorLvl},
+	}
+
+	for _, tt := range tests {
+		if tt.l.Level() != tt.want {
+			t.Errorf("Level of %s expected=%v got=%v", tt.l.Name(), tt.want, tt.l.Level())
+		}
+	}
+
+	SetLevelRule("*", AdminLvl)
+	if other.Level() != AdminLvl {
+		t.Errorf("Wildcard rule expected=%v got=%v", AdminLvl, other.Level())
+	}
+	if p.Level() != ErrorLvl {
+		t.Errorf("Explicit level overridden by rule. expected=%v got=%v", ErrorLvl, p.Level())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]Level{
+		"trace":   TraceLvl,
+		"DEBUG":   DebugLvl,
+		"Fine":    FineLvl,
+		"warning": WarningLvl,
+		"info ":   InfoLvl,
+		"error":   ErrorLvl,
+		"admin":   AdminLvl,
+		"fatal":   FatalLvl,
+		"none":    DisabledLvl,
+	}
+
+	for s, want := range tests {
+		lvl, err := ParseLevel(s)
+		if err != nil || lvl != want {
+			t.Errorf("ParseLevel(%q) expected=%v got=%v err=%v", s, want, lvl, err)
+		}
+	}
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	orig := rootLogger.Level()
+	defer SetLevel(orig)
+	defer ClearLevelRules()
+
+	if err := SetLevels("info, DSA.conn.*=trace"); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if rootLogger.Level() != InfoLvl {
+		t.Errorf("Root level expected=%v got=%v", InfoLvl, rootLogger.Level())
+	}
+	if l := New("conn").Child("x"); l.Level() != TraceLvl {
+		t.Errorf("Rule level expected=%v got=%v", TraceLvl, l.Level())
+	}
+
+	if err := SetLevels("debug,DSA.conn.*=loud"); err == nil {
+		t.Error("SetLevels accepted an invalid level")
+	}
+	if rootLogger.Level() != InfoLvl {
+		t.Error("SetLevels changed levels despite an error")
+	}
+	if err := SetLevels("=trace"); err == nil {
+		t.Error("SetLevels accepted a rule without a name")
+	}
+}
+
+func TestSetLevelsFromJSON(t *testing.T) {
+	orig := rootLogger.Level()
+	defer SetLevel(orig)
+	defer ClearLevelRules()
+
+	dj := `{"name": "dslink-go-test", "configs": {"log": {"type": "enum[all,trace,debug,info,warn,error,none]", "value": "debug,DSA.x.*=fatal", "default": "info"}}}`
+	if err := SetLevelsFromJSON([]byte(dj)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if rootLogger.Level() != DebugLvl {
+		t.Errorf("Root level expected=%v got=%v", DebugLvl, rootLogger.Level())
+	}
+	if l := New("x"); l.Level() != FatalLvl {
+		t.Errorf("Rule level expected=%v got=%v", FatalLvl, l.Level())
+	}
+
+	dj = `{"configs": {"log": {"default": "error"}}}`
+	if err := SetLevelsFromJSON([]byte(dj)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if rootLogger.Level() != ErrorLvl {
+		t.Errorf("Default level expected=%v got=%v", ErrorLvl, rootLogger.Level())
+	}
+
+	if err := SetLevelsFromJSON([]byte(`{"configs": {}}`)); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
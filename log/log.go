@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,6 +46,11 @@ func (l Level) String() string {
 	}
 }
 
+// name returns the string representation of the log Level without padding.
+func (l Level) name() string {
+	return strings.TrimSpace(l.String())
+}
+
 const (
 	// TraceLvl messages are used when debugging or developing. They are generally not enabled in production. This is the lowest level message.
 	TraceLvl Level = iota
@@ -69,10 +77,40 @@ const (
 var (
 	rootLogger *Logger
 	ch         chan *Record
-	och        chan io.Writer
 	out        io.Writer
+	formatter  Formatter
+	outLevel   Level
+	sch        chan func()
+	sinks      []Sink
+	closed     int32
+	fatalExit  int32
+	exit       = os.Exit
 )
 
+// Field is a key/value pair attached to a Logger and included in each Record it creates.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a new Field with the specified key and value.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// String returns the field as key=value. The value is quoted if it contains spaces,
+// quotes, or an equals sign.
+func (f Field) String() string {
+	return f.Key + "=" + quoteValue(fmt.Sprint(f.Value))
+}
+
+func quoteValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
 // Record is a structure for passing the data generated by loggers to a concurrency safe output writer.
 type Record struct {
 	// Time will be formatted as YYYY-MM-DD HH:MM:SS:ssss
@@ -81,19 +119,35 @@ type Record struct {
 	LoggerName string
 	Format     string
 	Args       []interface{}
-}
-
-func newRecord(lvl Level, logger, format string, args ...interface{}) *Record {
+	// Fields are the key/value pairs of the Logger which created this Record.
+	Fields []Field
+	// Caller is the file:line which created this Record. It is empty unless enabled with SetCaller.
+	Caller string
+	// Stack is the stack trace of the goroutine which created this Record. It is empty unless the
+	// Record's level is at or above the level set with SetStackLevel.
+	Stack string
+	// pc is the program counter of the caller, for loggers which forward records to log/slog.
+	pc uintptr
+}
+
+func newRecord(lvl Level, logger, format string, fields []Field, args ...interface{}) *Record {
 	return &Record{
 		Time:       time.Now(),
 		Level:      lvl,
 		LoggerName: logger,
 		Format:     format,
 		Args:       args,
+		Fields:     fields,
 	}
 }
 
-// Bytes creates a full byte representation of the data contained within this Record.
+// Message returns the formatted message of this Record.
+func (r *Record) Message() string {
+	return fmt.Sprintf(r.Format, r.Args...)
+}
+
+// Bytes creates a full byte representation of the data contained within this Record using the
+// default text layout, without a trailing newline.
 func (r *Record) Bytes() []byte {
 	var buf bytes.Buffer
 
@@ -102,7 +156,18 @@ func (r *Record) Bytes() []byte {
 	buf.WriteByte(']')
 	buf.WriteString(" " + r.Level.String() + " ")
 	buf.WriteString("[" + r.LoggerName + "] ")
-	buf.WriteString(fmt.Sprintf(r.Format, r.Args...))
+	if r.Caller != "" {
+		buf.WriteString(r.Caller + ": ")
+	}
+	buf.WriteString(r.Message())
+	for _, f := range r.Fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.String())
+	}
+	if r.Stack != "" {
+		buf.WriteByte('\n')
+		buf.WriteString(strings.TrimRight(r.Stack, "\n"))
+	}
 
 	return buf.Bytes()
 }
@@ -111,8 +176,13 @@ func (r *Record) Bytes() []byte {
 // Each logging operation makes a single call to the Writer's Write method. A Logger can be used
 // simultaneously from multiple goroutines. It guarantees to serialize access to the Writer.
 type Logger struct {
-	name  string
-	level Level
+	name     string
+	level    Level
+	levelSet bool
+	parent   *Logger
+	fields   []Field
+	// emit, if set, receives the records of this logger instead of the log queue.
+	emit func(r *Record)
 }
 
 // New creates a new Logger with the specified name. This will be prepended with the default logger's name. The
@@ -122,219 +192,355 @@ func New(name string) *Logger {
 }
 
 // Child will create a child logger of this logger. This will simply mean it inherits the log name of the parent.
-// It will also inherit the log level of the parent, but that may be changed.
+// Unless its level is set with SetLevel or a level rule matches its name, the child uses the current level of
+// the parent, so later changes to the parent's level also apply to the child.
+// Any fields of the parent are also included in the child.
 func (l *Logger) Child(name string) *Logger {
-	return &Logger{name: l.name + "." + name, level: l.level}
+	return &Logger{name: l.name + "." + name, parent: l, fields: l.fields, emit: l.emit}
+}
+
+// With creates a logger with the same name and level as this logger which adds the specified
+// fields to each of its log entries, after any fields of this logger.
+func (l *Logger) With(fields ...Field) *Logger {
+	fs := make([]Field, 0, len(l.fields)+len(fields))
+	fs = append(fs, l.fields...)
+	fs = append(fs, fields...)
+	return &Logger{name: l.name, parent: l, fields: fs, emit: l.emit}
+}
+
+// Name returns the full name of this logger.
+func (l *Logger) Name() string {
+	return l.name
 }
 
 // SetLevel sets the log level for this logger. Messages below this log level will be discarded.
+// This level takes precedence over any level rule matching the logger's name.
 func (l *Logger) SetLevel(level Level) {
+	lvlMu.Lock()
 	l.level = level
+	l.levelSet = true
+	lvlMu.Unlock()
+}
+
+// Level returns the current log level of this logger. This is the level set with SetLevel, otherwise the
+// level of the most specific rule matching the logger's name, otherwise the level of its parent.
+func (l *Logger) Level() Level {
+	lvlMu.RLock()
+	defer lvlMu.RUnlock()
+	return l.effectiveLevel()
 }
 
 // Logf creates a new log entry at the specified level with the format string specified for this logger.
 func (l *Logger) Logf(lvl Level, format string, args ...interface{}) {
-	if l.level > lvl {
-		return
+	l.log(lvl, format, args...)
+}
+
+// log creates the log entry. It must be called directly by the exported logging functions so the
+// caller of those functions can be found.
+func (l *Logger) log(lvl Level, format string, args ...interface{}) {
+	if l.Level() <= lvl && atomic.LoadInt32(&closed) == 0 {
+		r := newRecord(lvl, l.name, format, l.fields, args...)
+		addCaller(r, 2)
+
+		if l.emit != nil {
+			r.pc = callerPC(2)
+			l.emit(r)
+		} else {
+			enqueue(r)
+		}
 	}
-	r := newRecord(lvl, l.name, format, args...)
 
-	ch <- r
+	// Fatal exits even if the entry was filtered out or the log is closed.
+	if lvl == FatalLvl && atomic.LoadInt32(&fatalExit) != 0 {
+		Close()
+		exit(1)
+	}
 }
 
 // Trace creates a Trace Level log entry with the specified string for this logger.
 func (l *Logger) Trace(message string) {
-	l.Logf(TraceLvl, message)
+	l.log(TraceLvl, message)
 }
 
 // Tracef creates a Trace Level log entry with the format string specified for this logger.
 func (l *Logger) Tracef(format string, args ...interface{}) {
-	l.Logf(TraceLvl, format, args...)
+	l.log(TraceLvl, format, args...)
 }
 
 // Debug creates a Debug Level log entry with the specified string for this logger.
 func (l *Logger) Debug(message string) {
-	l.Logf(DebugLvl, message)
+	l.log(DebugLvl, message)
 }
 
 // Debugf creates a Debug Level log entry with the format string specified for this logger.
 func (l *Logger) Debugf(format string, args ...interface{}) {
-	l.Logf(DebugLvl, format, args...)
+	l.log(DebugLvl, format, args...)
 }
 
 // Fine creates a Fine Level log entry with the specified string for this logger.
 func (l *Logger) Fine(message string) {
-	l.Logf(FineLvl, message)
+	l.log(FineLvl, message)
 }
 
 // Finef creates a Fine Level log entry with the format string specified for this logger.
 func (l *Logger) Finef(format string, args ...interface{}) {
-	l.Logf(FineLvl, format, args...)
+	l.log(FineLvl, format, args...)
 }
 
 // Warn creates a Warn Level log entry with the specified string for this logger.
 func (l *Logger) Warn(message string) {
-	l.Logf(WarningLvl, message)
+	l.log(WarningLvl, message)
 }
 
 // Warnf creates a Warning Level log entry with the format string specified for this logger.
 func (l *Logger) Warnf(format string, args ...interface{}) {
-	l.Logf(WarningLvl, format, args...)
+	l.log(WarningLvl, format, args...)
 }
 
 // Info creates a Info Level log entry with the specified string for this logger.
 func (l *Logger) Info(message string) {
-	l.Logf(InfoLvl, message)
+	l.log(InfoLvl, message)
 }
 
 // Infof creates a Info Level log entry with the format string specified for this logger.
 func (l *Logger) Infof(format string, args ...interface{}) {
-	l.Logf(InfoLvl, format, args...)
+	l.log(InfoLvl, format, args...)
 }
 
 // Error creates a Error Level log entry with the specified string for this logger.
 func (l *Logger) Error(message string) {
-	l.Logf(ErrorLvl, message)
+	l.log(ErrorLvl, message)
 }
 
 // Errorf creates a Error Level log entry with the format string specified for this logger.
 func (l *Logger) Errorf(format string, args ...interface{}) {
-	l.Logf(ErrorLvl, format, args...)
+	l.log(ErrorLvl, format, args...)
 }
 
 // Admin creates a Admin Level log entry with the specified string for this logger.
 func (l *Logger) Admin(message string) {
-	l.Logf(AdminLvl, message)
+	l.log(AdminLvl, message)
 }
 
 // Adminf creates a Admin Level log entry with the format string specified for this logger.
 func (l *Logger) Adminf(format string, args ...interface{}) {
-	l.Logf(AdminLvl, format, args...)
+	l.log(AdminLvl, format, args...)
 }
 
 // Fatal creates a Fatal Level log entry with the specified string for this logger.
 func (l *Logger) Fatal(message string) {
-	l.Logf(FatalLvl, message)
+	l.log(FatalLvl, message)
 }
 
 // Fatalf creates a Fatal Level log entry with the format string specified for this logger.
 func (l *Logger) Fatalf(format string, args ...interface{}) {
-	l.Logf(FatalLvl, format, args...)
+	l.log(FatalLvl, format, args...)
 }
 
 // Default Logger
 
 // SetLevel sets the log level for the default logger. Messages below this log level will be discarded.
 func SetLevel(level Level) {
-	rootLogger.level = level
+	rootLogger.SetLevel(level)
+}
+
+// With creates a logger from the default logger which adds the specified fields to each of its log entries.
+func With(fields ...Field) *Logger {
+	return rootLogger.With(fields...)
 }
 
 // Logf creates a new log entry at the specified level with the format string specified for the default logger.
 func Logf(lvl Level, format string, args ...interface{}) {
-	rootLogger.Logf(lvl, format, args...)
+	rootLogger.log(lvl, format, args...)
 }
 
 // Trace creates a Trace Level log entry with the specified string for the default logger.
 func Trace(message string) {
-	rootLogger.Logf(TraceLvl, message)
+	rootLogger.log(TraceLvl, message)
 }
 
 // Tracef creates a Trace Level log entry with the format string specified for the default logger.
 func Tracef(format string, args ...interface{}) {
-	rootLogger.Logf(TraceLvl, format, args...)
+	rootLogger.log(TraceLvl, format, args...)
 }
 
 // Debug creates a Debug Level log entry with the specified string for the default logger.
 func Debug(message string) {
-	rootLogger.Logf(DebugLvl, message)
+	rootLogger.log(DebugLvl, message)
 }
 
 // Debugf creates a Debug Level log entry with the format string specified for the default logger.
 func Debugf(format string, args ...interface{}) {
-	rootLogger.Logf(DebugLvl, format, args...)
+	rootLogger.log(DebugLvl, format, args...)
 }
 
 // Fine creates a Fine Level log entry with the specified string for the default logger.
 func Fine(message string) {
-	rootLogger.Logf(FineLvl, message)
+	rootLogger.log(FineLvl, message)
 }
 
 // Finef creates a Fine Level log entry with the format string specified for the default logger.
 func Finef(format string, args ...interface{}) {
-	rootLogger.Logf(FineLvl, format, args...)
+	rootLogger.log(FineLvl, format, args...)
 }
 
 // Warn creates a Warn Level log entry with the specified string for the default logger.
 func Warn(message string) {
-	rootLogger.Logf(WarningLvl, message)
+	rootLogger.log(WarningLvl, message)
 }
 
 // Warnf creates a Warning Level log entry with the format string specified for the default logger.
 func Warnf(format string, args ...interface{}) {
-	rootLogger.Logf(WarningLvl, format, args...)
+	rootLogger.log(WarningLvl, format, args...)
 }
 
 // Info creates a Info Level log entry with the specified string for the default logger..
 func Info(message string) {
-	rootLogger.Logf(InfoLvl, message)
+	rootLogger.log(InfoLvl, message)
 }
 
 // Infof creates a Info Level log entry with the format string specified for the default logger.
 func Infof(format string, args ...interface{}) {
-	rootLogger.Logf(InfoLvl, format, args...)
+	rootLogger.log(InfoLvl, format, args...)
 }
 
 // Error creates a Error Level log entry with the specified string for the default logger..
 func Error(message string) {
-	rootLogger.Logf(ErrorLvl, message)
+	rootLogger.log(ErrorLvl, message)
 }
 
 // Errorf creates a Error Level log entry with the format string specified for the default logger.
 func Errorf(format string, args ...interface{}) {
-	rootLogger.Logf(ErrorLvl, format, args...)
+	rootLogger.log(ErrorLvl, format, args...)
 }
 
 // Admin creates a Admin Level log entry with the specified string for the default logger.
 func Admin(message string) {
-	rootLogger.Logf(AdminLvl, message)
+	rootLogger.log(AdminLvl, message)
 }
 
 // Adminf creates a Admin Level log entry with the format string specified for the default logger.
 func Adminf(format string, args ...interface{}) {
-	rootLogger.Logf(AdminLvl, format, args...)
+	rootLogger.log(AdminLvl, format, args...)
 }
 
 // Fatal creates a Fatal Level log entry with the specified string for the default logger.
 func Fatal(message string) {
-	rootLogger.Logf(FatalLvl, message)
+	rootLogger.log(FatalLvl, message)
 }
 
 // Fatalf creates a Fatal Level log entry with the format string specified for the default logger.
 func Fatalf(format string, args ...interface{}) {
-	rootLogger.Logf(FatalLvl, format, args...)
+	rootLogger.log(FatalLvl, format, args...)
 }
 
-// SetOutput sets the specified writer to be the output destination of logs.
+// SetOutput sets the specified writer to be the output destination of logs. A nil writer disables
+// the output, leaving only the destinations added with AddSink. If the log was closed with Close,
+// logging is restarted. Entries queued before the call may be written to either output, but the
+// previous output is no longer written to once SetOutput returns.
 func SetOutput(w io.Writer) {
-	och <- w
+	apply(func() {
+		out = w
+	})
+	atomic.StoreInt32(&closed, 0)
+}
+
+// SetFormatter sets the Formatter used to convert log entries before they are written to the output.
+// The default is TextFormatter.
+func SetFormatter(f Formatter) {
+	apply(func() {
+		formatter = f
+	})
+}
+
+// apply runs fn on the logging goroutine and waits for it to return.
+func apply(fn func()) {
+	done := make(chan struct{})
+	sch <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// Flush blocks until all log entries queued before the call have been written to the output and sinks.
+func Flush() {
+	apply(drain)
+}
+
+// Close flushes all queued log entries and then closes the output and any sinks which implement io.Closer,
+// other than os.Stdout and os.Stderr. Log entries created after Close are discarded until logging is
+// restarted by setting a new output with SetOutput or adding a sink with AddSink.
+func Close() {
+	if !atomic.CompareAndSwapInt32(&closed, 0, 1) {
+		return
+	}
+
+	apply(func() {
+		drain()
+		_ = closeWriter(out)
+		for _, s := range sinks {
+			_ = closeWriter(s)
+		}
+		out = nil
+		sinks = nil
+	})
+}
+
+// SetFatalExit enables or disables exiting after Fatal log entries. When enabled, a Fatal or Fatalf entry
+// from any logger will Close the log, so the entry is written, and then exit the program with status 1.
+// The program exits even if the logger's level discards the entry or the log is already closed.
+func SetFatalExit(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&fatalExit, v)
+}
+
+func closeWriter(v interface{}) error {
+	if v == os.Stdout || v == os.Stderr {
+		return nil
+	}
+	if c, ok := v.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// drain writes all records currently queued.
+func drain() {
+	for {
+		select {
+		case r := <-ch:
+			dispatch(r)
+		default:
+			return
+		}
+	}
 }
 
 func init() {
 	rootLogger = &Logger{name: "DSA", level: WarningLvl}
 	ch = make(chan *Record, 10)
-	och = make(chan io.Writer)
 	out = os.Stdout
+	formatter = TextFormatter{}
+	outLevel = TraceLvl
+	sch = make(chan func())
 
 	go printLog()
 }
 
 func printLog() {
+	t := time.NewTicker(dropReportInterval)
 	for {
 		select {
+		case <-t.C:
+			reportDropped()
 		case r := <-ch:
-			_, _ = out.Write(r.Bytes())
-		case o := <-och:
-			out = o
+			dispatch(r)
+		case fn := <-sch:
+			fn()
 		}
 	}
 }
@@ -229,3 +229,60 @@ func testFormattedLevels(t *testing.T, logger *Logger, tests []formattedLogTest,
 		}
 	}
 }
+
+func TestLogger_With(t *testing.T) {
+	buf := newWriter()
+	SetOutput(buf)
+
+	l := New("Test").With(F("path", "/downstream/a"), F("rid", 3))
+	l.SetLevel(DebugLvl)
+	l.Debug("with fields")
+
+	<-buf.ch
+	str := strings.TrimSpace(buf.String())
+
+	if !strings.HasSuffix(str, "with fields path=/downstream/a rid=3") {
+		t.Errorf("Logged line does not contain fields: %q", str)
+	}
+
+	buf.buf.Reset()
+	c := l.Child("Sub").With(F("dsId", "a b"))
+	c.Debug("child")
+
+	<-buf.ch
+	str = strings.TrimSpace(buf.String())
+
+	if !strings.Contains(str, "[DSA.Test.Sub]") {
+		t.Errorf("unexpected logger name: %q", str)
+	}
+	if !strings.HasSuffix(str, "child path=/downstream/a rid=3 dsId=\"a b\"") {
+		t.Errorf("Logged line does not contain inherited fields: %q", str)
+	}
+
+	buf.buf.Reset()
+	l.Debug("parent")
+
+	<-buf.ch
+	str = buf.String()
+	if strings.Contains(str, "dsId") {
+		t.Errorf("Child fields leaked into parent: %q", str)
+	}
+}
+
+func TestField_String(t *testing.T) {
+	tests := []struct {
+		f    Field
+		want string
+	}{
+		{F("a", 1), "a=1"},
+		{F("a", "b c"), `a="b c"`},
+		{F("a", ""), `a=""`},
+		{F("a", `x="y"`), `a="x=\"y\""`},
+	}
+
+	for _, tt := range tests {
+		if tt.f.String() != tt.want {
+			t.Errorf("Field.String expected=%q got=%q", tt.want, tt.f.String())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Overflow determines what happens to a log entry created while the queue of entries waiting to be
+// written is full.
+type Overflow int32
+
+const (
+	// Block waits until there is room in the queue. This is the default. No entries are lost but a slow
+	// output will stall the goroutines which are logging.
+	Block Overflow = iota
+	// DropNewest discards the new entry.
+	DropNewest
+	// DropOldest discards the oldest queued entry to make room for the new entry.
+	DropOldest
+)
+
+// dropReportInterval is how often the number of dropped entries is logged.
+const dropReportInterval = time.Minute
+
+var (
+	overflow int32
+	dropped  uint64
+	reported uint64
+)
+
+// SetOverflow sets the policy used when the log queue is full.
+func SetOverflow(o Overflow) {
+	atomic.StoreInt32(&overflow, int32(o))
+}
+
+// Dropped returns the total number of log entries discarded because the queue was full.
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
+}
+
+// enqueue adds the record to the queue according to the current Overflow policy.
+func enqueue(r *Record) {
+	switch Overflow(atomic.LoadInt32(&overflow)) {
+	case DropNewest:
+		select {
+		case ch <- r:
+		default:
+			atomic.AddUint64(&dropped, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case ch <- r:
+				return
+			default:
+			}
+			select {
+			case <-ch:
+				atomic.AddUint64(&dropped, 1)
+			default:
+			}
+		}
+	default:
+		ch <- r
+	}
+}
+
+// reportDropped writes a warning to the outputs if entries have been dropped since the last report.
+// It is called from the logging goroutine.
+func reportDropped() {
+	d := atomic.LoadUint64(&dropped)
+	if d == reported {
+		return
+	}
+
+	n := d - reported
+	reported = d
+	dispatch(newRecord(WarningLvl, rootLogger.name, "Dropped %d log entries, %d in total", []Field{F("dropped", n)}, n, d))
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// blockWriter blocks each write until a value is received on release.
+type blockWriter struct {
+	started chan bool
+	release chan bool
+	lines   []string
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	bw.started <- true
+	<-bw.release
+	bw.lines = append(bw.lines, string(p))
+	return len(p), nil
+}
+
+func testOverflow(t *testing.T, o Overflow) *blockWriter {
+	t.Helper()
+	bw := &blockWriter{started: make(chan bool), release: make(chan bool)}
+	SetOutput(bw)
+	SetOverflow(o)
+
+	l := New("Overflow")
+	l.SetLevel(TraceLvl)
+
+	// The first entry is taken by the logging goroutine, which then blocks in Write.
+	l.Info("entry 0")
+	<-bw.started
+
+	before := Dropped()
+	for i := 1; i <= cap(ch)+5; i++ {
+		l.Infof("entry %d", i)
+	}
+	if d := Dropped() - before; d != 5 {
+		t.Errorf("Dropped entries expected=5 got=%d", d)
+	}
+
+	SetOverflow(Block)
+	go func() {
+		for range bw.started {
+			bw.release <- true
+		}
+	}()
+	bw.release <- true
+	Flush()
+	SetOutput(os.Stdout)
+	close(bw.started)
+
+	return bw
+}
+
+func TestOverflow_DropNewest(t *testing.T) {
+	bw := testOverflow(t, DropNewest)
+
+	last := bw.lines[len(bw.lines)-1]
+	if !strings.Contains(last, "entry 10") {
+		t.Errorf("Last written entry expected=%q got=%q", "entry 10", last)
+	}
+}
+
+func TestOverflow_DropOldest(t *testing.T) {
+	bw := testOverflow(t, DropOldest)
+
+	if len(bw.lines) < 2 || !strings.Contains(bw.lines[1], "entry 6") {
+		t.Errorf("First queued entry expected=%q got=%q", "entry 6", bw.lines)
+	}
+	last := bw.lines[len(bw.lines)-1]
+	if !strings.Contains(last, "entry 15") {
+		t.Errorf("Last written entry expected=%q got=%q", "entry 15", last)
+	}
+}
+
+func TestReportDropped(t *testing.T) {
+	recs := make(chan *Record, 2)
+	s := NewFuncSink(func(r *Record) { recs <- r }, TraceLvl)
+	AddSink(s)
+	defer RemoveSink(s)
+
+	before := Dropped()
+	done := make(chan bool)
+	sch <- func() {
+		reported = atomic.LoadUint64(&dropped)
+		atomic.AddUint64(&dropped, 3)
+		reportDropped()
+		reportDropped()
+		done <- true
+	}
+	<-done
+
+	r := <-recs
+	if r.Level != WarningLvl || !strings.Contains(r.Message(), "Dropped 3 log entries") {
+		t.Errorf("Unexpected drop report: %s %q", r.Level, r.Message())
+	}
+	if Dropped() != before+3 {
+		t.Errorf("Dropped expected=%d got=%d", before+3, Dropped())
+	}
+	select {
+	case r = <-recs:
+		t.Errorf("Drop report repeated without new drops: %q", r.Message())
+	default:
+	}
+}
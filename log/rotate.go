@@ -0,0 +1,340 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backupFormat is appended to the file name of rotated files.
+const backupFormat = "20060102-150405.000"
+
+// RotatingFile is a log output which writes to a file, rotating it once it reaches a maximum
+// size or age. Rotated files are renamed with a timestamp suffix and may be compressed with gzip.
+// The file is also reopened when the process receives SIGHUP, so it may be moved by external tools.
+// A RotatingFile may be used with SetOutput or NewWriterSink.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File // nil if closed, or if the file could not be reopened
+	closed bool
+	size   int64
+	opened time.Time
+	sig    chan os.Signal
+	done   chan struct{}
+	wg     sync.WaitGroup
+	bgMu   sync.Mutex // serializes compression and pruning of backups
+}
+
+// MaxSize rotates the file before a write would make it larger than size bytes.
+func MaxSize(size int64) func(rf *RotatingFile) {
+	return func(rf *RotatingFile) {
+		rf.maxSize = size
+	}
+}
+
+// MaxAge rotates the file once it is older than age. The age of a file which already had
+// content when it was opened is counted from when it was last modified, so a file left by an
+// earlier run is rotated no later than age after its last write.
+func MaxAge(age time.Duration) func(rf *RotatingFile) {
+	return func(rf *RotatingFile) {
+		rf.maxAge = age
+	}
+}
+
+// MaxBackups sets the number of rotated files to keep. Older files are removed.
+func MaxBackups(n int) func(rf *RotatingFile) {
+	return func(rf *RotatingFile) {
+		rf.maxBackups = n
+	}
+}
+
+// Compress rotated files with gzip.
+func Compress(rf *RotatingFile) {
+	rf.compress = true
+}
+
+// NewRotatingFile opens, or creates, the file at path for appending log output. Without options
+// the file is never rotated and all backups are kept.
+func NewRotatingFile(path string, opts ...func(rf *RotatingFile)) (*RotatingFile, error) {
+	rf := &RotatingFile{path: filepath.Clean(path)}
+
+	for _, opt := range opts {
+		opt(rf)
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	rf.sig = make(chan os.Signal, 1)
+	rf.done = make(chan struct{})
+	signal.Notify(rf.sig, syscall.SIGHUP)
+	go rf.watch()
+
+	return rf, nil
+}
+
+// Write writes p to the file, rotating it first if required. If the file could not be
+// reopened after a rotation or SIGHUP, opening it is retried.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file, renames it as a backup and opens a new file.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return os.ErrClosed
+	}
+	if rf.file == nil {
+		return rf.open()
+	}
+	return rf.rotate()
+}
+
+// Reopen closes and reopens the file at its path. This is called when the process receives SIGHUP.
+func (rf *RotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return os.ErrClosed
+	}
+
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	if oerr := rf.open(); oerr != nil {
+		return oerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to close log file %q: %v", rf.path, err)
+	}
+	return nil
+}
+
+// Close closes the file and waits for any compression of rotated files to complete.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	if rf.closed {
+		rf.mu.Unlock()
+		return os.ErrClosed
+	}
+
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	rf.closed = true
+	signal.Stop(rf.sig)
+	close(rf.done)
+	rf.mu.Unlock()
+
+	rf.wg.Wait()
+	return err
+}
+
+func (rf *RotatingFile) watch() {
+	for {
+		select {
+		case <-rf.sig:
+			_ = rf.Reopen()
+		case <-rf.done:
+			return
+		}
+	}
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file %q: %v", rf.path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to open log file %q: %v", rf.path, err)
+	}
+
+	rf.file = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	if rf.size > 0 {
+		rf.opened = fi.ModTime()
+	}
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge
+}
+
+// rotate renames the file as a backup and opens a new file. If the file cannot be closed
+// or reopened, rf.file is left nil so the next Write retries the open.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err != nil {
+		return fmt.Errorf("unable to close log file %q: %v", rf.path, err)
+	}
+
+	backup := rf.backupName(time.Now())
+	if err := os.Rename(rf.path, backup); err != nil && !os.IsNotExist(err) {
+		// Keep writing to the existing file rather than losing output.
+		_ = rf.open()
+		return fmt.Errorf("unable to rotate log file %q: %v", rf.path, err)
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		rf.bgMu.Lock()
+		defer rf.bgMu.Unlock()
+		if rf.compress {
+			_ = compressFile(backup)
+		}
+		rf.prune()
+	}()
+
+	return nil
+}
+
+// backupName returns an unused name for a backup rotated at t.
+func (rf *RotatingFile) backupName(t time.Time) string {
+	for {
+		name := rf.path + "." + t.Format(backupFormat)
+		_, err := os.Stat(name)
+		_, gzErr := os.Stat(name + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// prune removes the oldest backups so at most maxBackups remain.
+func (rf *RotatingFile) prune() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+
+	backups := rf.backups()
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+
+	for _, b := range backups[:len(backups)-rf.maxBackups] {
+		_ = os.Remove(b)
+	}
+}
+
+// backups returns the rotated files of this RotatingFile, oldest first.
+func (rf *RotatingFile) backups() []string {
+	matches, _ := filepath.Glob(globEscape(rf.path) + ".*")
+
+	var backups []string
+	for _, m := range matches {
+		ts := strings.TrimSuffix(strings.TrimPrefix(m, rf.path+"."), ".gz")
+		if _, err := time.Parse(backupFormat, ts); err == nil {
+			backups = append(backups, m)
+		}
+	}
+
+	sort.Strings(backups)
+	return backups
+}
+
+// globEscape escapes the special characters of filepath.Match in path.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		switch {
+		case c == '*' || c == '?' || c == '[':
+			b.WriteString("[" + string(c) + "]")
+		case c == '\\' && runtime.GOOS != "windows":
+			b.WriteString("\\\\")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
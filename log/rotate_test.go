@@ -0,0 +1,261 @@
+package log
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func tempLogDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dslink-log")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return dir
+}
+
+func TestRotatingFile_Size(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link.log")
+
+	rf, err := NewRotatingFile(path, MaxSize(10))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	for _, s := range []string{"123456\n", "abcdef\n", "ghijkl\n"} {
+		if _, err = rf.Write([]byte(s)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "ghijkl\n" {
+		t.Errorf("Current file expected=%q got=%q", "ghijkl\n", b)
+	}
+
+	backups := rf.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Number of backups expected=2 got=%d: %v", len(backups), backups)
+	}
+	b, _ = ioutil.ReadFile(backups[0])
+	if string(b) != "123456\n" {
+		t.Errorf("Oldest backup expected=%q got=%q", "123456\n", b)
+	}
+}
+
+func TestRotatingFile_Age(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link.log")
+
+	rf, err := NewRotatingFile(path, MaxAge(time.Millisecond))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	_, _ = rf.Write([]byte("first\n"))
+	time.Sleep(5 * time.Millisecond)
+	_, _ = rf.Write([]byte("second\n"))
+	_ = rf.Close()
+
+	if n := len(rf.backups()); n != 1 {
+		t.Errorf("Number of backups expected=1 got=%d", n)
+	}
+}
+
+func TestRotatingFile_CompressAndPrune(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link.log")
+
+	rf, err := NewRotatingFile(path, MaxBackups(2), Compress)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		_, _ = rf.Write([]byte("line\n"))
+		if err = rf.Rotate(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	_ = rf.Close()
+
+	backups := rf.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Number of backups expected=2 got=%d: %v", len(backups), backups)
+	}
+
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".gz") {
+			t.Errorf("Backup was not compressed: %q", b)
+			continue
+		}
+		f, _ := os.Open(b)
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Unable to read compressed backup %q: %v", b, err)
+		}
+		d, _ := ioutil.ReadAll(zr)
+		f.Close()
+		if string(d) != "line\n" {
+			t.Errorf("Compressed backup expected=%q got=%q", "line\n", d)
+		}
+	}
+}
+
+func TestRotatingFile_Reopen(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link.log")
+	moved := filepath.Join(dir, "moved.log")
+
+	rf, err := NewRotatingFile(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer rf.Close()
+
+	_, _ = rf.Write([]byte("before\n"))
+	_ = os.Rename(path, moved)
+
+	rf.sig <- syscall.SIGHUP
+
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, _ = rf.Write([]byte("after\n"))
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "after\n" {
+		t.Errorf("Reopened file expected=%q got=%q", "after\n", b)
+	}
+	b, _ = ioutil.ReadFile(moved)
+	if string(b) != "before\n" {
+		t.Errorf("Moved file expected=%q got=%q", "before\n", b)
+	}
+}
+
+func TestRotatingFile_ReopenFailure(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "logs")
+	_ = os.Mkdir(sub, 0755)
+	path := filepath.Join(sub, "link.log")
+
+	rf, err := NewRotatingFile(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer rf.Close()
+
+	_ = os.RemoveAll(sub)
+	if err = rf.Reopen(); err == nil {
+		t.Fatal("Expected error reopening file in removed directory")
+	}
+	if _, err = rf.Write([]byte("lost\n")); err == nil || err == os.ErrClosed {
+		t.Errorf("Write expected open error got=%v", err)
+	}
+
+	// Writes retry opening the file once it can be created.
+	_ = os.Mkdir(sub, 0755)
+	if _, err = rf.Write([]byte("after\n")); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "after\n" {
+		t.Errorf("Reopened file expected=%q got=%q", "after\n", b)
+	}
+
+	if err = rf.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err = rf.Write([]byte("closed\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close expected=%v got=%v", os.ErrClosed, err)
+	}
+}
+
+func TestRotatingFile_AgeExisting(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link.log")
+
+	// A file last written before the maximum age is rotated on the first write.
+	_ = ioutil.WriteFile(path, []byte("old\n"), 0644)
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(path, old, old)
+
+	rf, err := NewRotatingFile(path, MaxAge(time.Minute))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, _ = rf.Write([]byte("new\n"))
+	_ = rf.Close()
+
+	if n := len(rf.backups()); n != 1 {
+		t.Errorf("Number of backups expected=1 got=%d", n)
+	}
+}
+
+func TestRotatingFile_UncleanPath(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	rf, err := NewRotatingFile(dir+"/./link.log", MaxBackups(1))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for i := 0; i < 4; i++ {
+		_, _ = rf.Write([]byte("line\n"))
+		if err = rf.Rotate(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	_ = rf.Close()
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "link.log.*")); len(matches) != 1 {
+		t.Errorf("Number of backups expected=1 got=%d: %v", len(matches), matches)
+	}
+}
+
+func TestRotatingFile_GlobPath(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "link[1]*.log")
+	other := filepath.Join(dir, "link1x.log.20200101-000000.000")
+	_ = ioutil.WriteFile(other, nil, 0644)
+
+	rf, err := NewRotatingFile(path, MaxBackups(1))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = rf.Write([]byte("line\n"))
+		if err = rf.Rotate(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	_ = rf.Close()
+
+	if backups := rf.backups(); len(backups) != 1 || !strings.HasPrefix(backups[0], path+".") {
+		t.Errorf("Backups expected one of %q got=%v", path, backups)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Error("Backup of another file was pruned:", err)
+	}
+}
@@ -0,0 +1,107 @@
+package log
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Sink is an additional destination for log records. Each Sink has its own minimum Level,
+// records below that level are not passed to it. Sinks are called from the logging
+// goroutine, so a Sink does not need to be safe for concurrent use.
+type Sink interface {
+	// Level returns the minimum Level of records this Sink accepts.
+	Level() Level
+	// Log writes the record to the Sink.
+	Log(r *Record) error
+}
+
+type writerSink struct {
+	w   io.Writer
+	lvl Level
+	f   Formatter
+}
+
+// NewWriterSink creates a Sink which writes records at or above lvl to w, formatted with f.
+// If f is nil the TextFormatter is used.
+func NewWriterSink(w io.Writer, lvl Level, f Formatter) Sink {
+	if f == nil {
+		f = TextFormatter{}
+	}
+	return &writerSink{w: w, lvl: lvl, f: f}
+}
+
+func (s *writerSink) Level() Level {
+	return s.lvl
+}
+
+func (s *writerSink) Log(r *Record) error {
+	_, err := s.w.Write(s.f.Format(r))
+	return err
+}
+
+// Close closes the underlying writer if it implements io.Closer.
+func (s *writerSink) Close() error {
+	return closeWriter(s.w)
+}
+
+type funcSink struct {
+	fn  func(r *Record)
+	lvl Level
+}
+
+// NewFuncSink creates a Sink which calls fn with each record at or above lvl. fn is called
+// from the logging goroutine and must not block or log itself.
+func NewFuncSink(fn func(r *Record), lvl Level) Sink {
+	return &funcSink{fn: fn, lvl: lvl}
+}
+
+func (s *funcSink) Level() Level {
+	return s.lvl
+}
+
+func (s *funcSink) Log(r *Record) error {
+	s.fn(r)
+	return nil
+}
+
+// AddSink adds a destination which receives records in addition to the output set by SetOutput.
+// If the log was closed with Close, logging is restarted.
+func AddSink(s Sink) {
+	apply(func() {
+		sinks = append(sinks, s)
+	})
+	atomic.StoreInt32(&closed, 0)
+}
+
+// RemoveSink removes a destination previously added with AddSink.
+func RemoveSink(s Sink) {
+	apply(func() {
+		for i, ss := range sinks {
+			if ss == s {
+				sinks = append(sinks[:i:i], sinks[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// SetOutputLevel sets the minimum level of records written to the output set by SetOutput. The
+// default is TraceLvl, so every record which passes its logger's level is written.
+func SetOutputLevel(lvl Level) {
+	apply(func() {
+		outLevel = lvl
+	})
+}
+
+// dispatch writes the record to the output and each sink which accepts its level.
+func dispatch(r *Record) {
+	if out != nil && r.Level >= outLevel {
+		_, _ = out.Write(formatter.Format(r))
+	}
+
+	for _, s := range sinks {
+		if r.Level >= s.Level() {
+			_ = s.Log(r)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	out := newWriter()
+	SetOutput(out)
+	SetOutputLevel(InfoLvl)
+	defer SetOutput(os.Stdout)
+	defer SetOutputLevel(TraceLvl)
+
+	file := new(bytes.Buffer)
+	fs := NewWriterSink(file, TraceLvl, LogfmtFormatter{})
+	AddSink(fs)
+	defer RemoveSink(fs)
+
+	recs := make(chan *Record, 10)
+	cb := NewFuncSink(func(r *Record) { recs <- r }, AdminLvl)
+	AddSink(cb)
+	defer RemoveSink(cb)
+
+	l := New("Sinks")
+	l.SetLevel(TraceLvl)
+
+	l.Trace("trace msg")
+	l.Info("info msg")
+	<-out.ch
+	l.Admin("admin msg")
+	<-out.ch
+	r := <-recs
+
+	if strings.Contains(out.String(), "trace msg") {
+		t.Errorf("Output received record below its level: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "info msg") || !strings.Contains(out.String(), "admin msg") {
+		t.Errorf("Output missing records: %q", out.String())
+	}
+
+	if r.Message() != "admin msg" {
+		t.Errorf("Callback sink received unexpected record. expected=%q got=%q", "admin msg", r.Message())
+	}
+	select {
+	case r = <-recs:
+		t.Errorf("Callback sink received record below its level: %q", r.Message())
+	default:
+	}
+
+	// All sinks have been written to once out has received the admin record.
+	f := file.String()
+	for _, m := range []string{"msg=\"trace msg\"", "msg=\"info msg\"", "msg=\"admin msg\""} {
+		if !strings.Contains(f, m) {
+			t.Errorf("File sink missing %s: %q", m, f)
+		}
+	}
+
+	RemoveSink(cb)
+	l.Admin("after remove")
+	<-out.ch
+	select {
+	case r = <-recs:
+		t.Errorf("Removed sink received record: %q", r.Message())
+	default:
+	}
+}
+
+func TestSetOutputNil(t *testing.T) {
+	SetOutput(nil)
+	defer SetOutput(os.Stdout)
+
+	recs := make(chan *Record, 1)
+	cb := NewFuncSink(func(r *Record) { recs <- r }, TraceLvl)
+	AddSink(cb)
+	defer RemoveSink(cb)
+
+	l := New("Nil")
+	l.SetLevel(TraceLvl)
+	l.Warn("only sink")
+	if r := <-recs; r.Message() != "only sink" {
+		t.Errorf("Sink received unexpected record. expected=%q got=%q", "only sink", r.Message())
+	}
+}
@@ -0,0 +1,163 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Levels of log/slog which correspond to the levels of this package that log/slog does not define.
+// DebugLvl, InfoLvl, WarningLvl and ErrorLvl correspond to slog.LevelDebug, slog.LevelInfo,
+// slog.LevelWarn and slog.LevelError.
+const (
+	SlogLevelTrace = slog.Level(-8)
+	SlogLevelFine  = slog.Level(-2)
+	SlogLevelAdmin = slog.Level(10)
+	SlogLevelFatal = slog.Level(12)
+)
+
+// FromSlogLevel converts a log/slog level into the nearest Level at or below it.
+func FromSlogLevel(lvl slog.Level) Level {
+	switch {
+	case lvl < slog.LevelDebug:
+		return TraceLvl
+	case lvl < SlogLevelFine:
+		return DebugLvl
+	case lvl < slog.LevelInfo:
+		return FineLvl
+	case lvl < slog.LevelWarn:
+		return InfoLvl
+	case lvl < slog.LevelError:
+		return WarningLvl
+	case lvl < SlogLevelAdmin:
+		return ErrorLvl
+	case lvl < SlogLevelFatal:
+		return AdminLvl
+	default:
+		return FatalLvl
+	}
+}
+
+// ToSlogLevel converts a Level into the corresponding log/slog level.
+func ToSlogLevel(lvl Level) slog.Level {
+	switch lvl {
+	case TraceLvl:
+		return SlogLevelTrace
+	case DebugLvl:
+		return slog.LevelDebug
+	case FineLvl:
+		return SlogLevelFine
+	case WarningLvl:
+		return slog.LevelWarn
+	case InfoLvl:
+		return slog.LevelInfo
+	case ErrorLvl:
+		return slog.LevelError
+	case AdminLvl:
+		return SlogLevelAdmin
+	default:
+		return SlogLevelFatal
+	}
+}
+
+// slogHandler is a slog.Handler which writes records through a Logger.
+type slogHandler struct {
+	l     *Logger
+	group string
+}
+
+// NewSlogHandler creates a slog.Handler which forwards records to the log queue as entries of l, so
+// they are filtered by the level of l and written to the output and sinks of this package. If l is nil
+// the default logger is used. Fatal entries created through the handler do not exit the program.
+func NewSlogHandler(l *Logger) slog.Handler {
+	if l == nil {
+		l = rootLogger
+	}
+	return &slogHandler{l: l}
+}
+
+func (h *slogHandler) Enabled(_ context.Context, lvl slog.Level) bool {
+	return FromSlogLevel(lvl) >= h.l.Level() && atomic.LoadInt32(&closed) == 0
+}
+
+func (h *slogHandler) Handle(_ context.Context, sr slog.Record) error {
+	fs := make([]Field, 0, len(h.l.fields)+sr.NumAttrs())
+	fs = append(fs, h.l.fields...)
+	sr.Attrs(func(a slog.Attr) bool {
+		fs = appendAttr(fs, h.group, a)
+		return true
+	})
+
+	r := newRecord(FromSlogLevel(sr.Level), h.l.name, "%s", fs, sr.Message)
+	r.Time = sr.Time
+	if sr.PC != 0 && (atomic.LoadInt32(&callerEnabled) != 0 || r.Level >= Level(atomic.LoadInt32(&stackLevel))) {
+		setCaller(r, []uintptr{sr.PC}, false)
+	}
+
+	enqueue(r)
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var fs []Field
+	for _, a := range attrs {
+		fs = appendAttr(fs, h.group, a)
+	}
+	return &slogHandler{l: h.l.With(fs...), group: h.group}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{l: h.l, group: h.group + name + "."}
+}
+
+// appendAttr adds the attribute to fs, with its key prefixed by group. Group attributes are flattened
+// into one Field for each of their members.
+func appendAttr(fs []Field, group string, a slog.Attr) []Field {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		prefix := group
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			fs = appendAttr(fs, prefix, ga)
+		}
+		return fs
+	}
+
+	if a.Key == "" {
+		return fs
+	}
+	return append(fs, F(group+a.Key, v.Any()))
+}
+
+// FromSlog creates a Logger which writes its entries to the handler of s, rather than the output and
+// sinks of this package. The logger is a child of the default logger and its level is configured in the
+// same way as any other logger, entries are also filtered by the handler. The logger name is added to
+// each record as the "logger" attribute.
+func FromSlog(s *slog.Logger) *Logger {
+	h := s.Handler()
+	emit := func(r *Record) {
+		lvl := ToSlogLevel(r.Level)
+		ctx := context.Background()
+		if !h.Enabled(ctx, lvl) {
+			return
+		}
+
+		sr := slog.NewRecord(r.Time, lvl, r.Message(), r.pc)
+		sr.AddAttrs(slog.String("logger", r.LoggerName))
+		for _, f := range r.Fields {
+			sr.AddAttrs(slog.Any(f.Key, f.Value))
+		}
+		if r.Stack != "" {
+			sr.AddAttrs(slog.String("stack", strings.TrimRight(r.Stack, "\n")))
+		}
+		_ = h.Handle(ctx, sr)
+	}
+
+	return &Logger{name: rootLogger.name, parent: rootLogger, emit: emit}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSlogLevels(t *testing.T) {
+	levels := []Level{TraceLvl, DebugLvl, FineLvl, WarningLvl, InfoLvl, ErrorLvl, AdminLvl, FatalLvl}
+	for _, lvl := range levels {
+		if got := FromSlogLevel(ToSlogLevel(lvl)); got != lvl {
+			t.Errorf("Level round trip expected=%v got=%v", lvl, got)
+		}
+	}
+
+	tests := map[slog.Level]Level{
+		slog.LevelDebug - 1: TraceLvl,
+		slog.LevelDebug:     DebugLvl,
+		slog.LevelInfo:      InfoLvl,
+		slog.LevelWarn:      WarningLvl,
+		slog.LevelError:     ErrorLvl,
+		slog.LevelError + 1: ErrorLvl,
+		SlogLevelAdmin:      AdminLvl,
+		SlogLevelFatal + 4:  FatalLvl,
+	}
+	for sl, want := range tests {
+		if got := FromSlogLevel(sl); got != want {
+			t.Errorf("FromSlogLevel(%v) expected=%v got=%v", sl, want, got)
+		}
+	}
+}
+
+func TestNewSlogHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	defer SetOutput(os.Stdout)
+
+	l := New("Slog")
+	l.SetLevel(WarningLvl)
+	s := slog.New(NewSlogHandler(l)).With("dsId", "link-1").WithGroup("req")
+
+	s.Debug("hidden")
+	s.Info("request", "rid", 3, slog.Group("node", "path", "/a"))
+	s.Log(context.Background(), SlogLevelAdmin, "admin")
+	Flush()
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("Entry below logger level was written: %q", out)
+	}
+	if !strings.Contains(out, "INFO  [DSA.Slog] request dsId=link-1 req.rid=3 req.node.path=/a") {
+		t.Errorf("Unexpected info entry: %q", out)
+	}
+	if !strings.Contains(out, "ADMIN [DSA.Slog] admin dsId=link-1") {
+		t.Errorf("Unexpected admin entry: %q", out)
+	}
+}
+
+func TestFromSlog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: SlogLevelTrace}))
+
+	l := FromSlog(s).Child("Bridge").With(F("path", "/downstream"))
+	l.SetLevel(FineLvl)
+	l.Debug("hidden")
+	l.Adminf("value %d", 5)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Logged lines expected=1 got=%d: %q", len(lines), buf.String())
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"level":  "ERROR+2",
+		"msg":    "value 5",
+		"logger": "DSA.Bridge",
+		"path":   "/downstream",
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("slog attribute %q expected=%v got=%v", k, v, m[k])
+		}
+	}
+}
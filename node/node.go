@@ -0,0 +1,533 @@
+// Package node implements the node tree of a responder. Nodes have configs, prefixed with $,
+// attributes, prefixed with @, an optional value and children. A tree may be serialized to
+// nodes.json and restored when the link starts, rebuilding dynamic nodes from their profile.
+// A Responder serves the tree to a broker, handling list, subscribe, set and invoke requests.
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/log"
+)
+
+// Action is called when a node is invoked. It returns the rows of the invoke response.
+type Action func(n *Node, params map[string]interface{}) ([][]interface{}, error)
+
+// SetHandler is called when a set request writes v to a node. It returns the value to set,
+// which may be v or a transformation of it, or an error to reject the write.
+type SetHandler func(n *Node, v interface{}) (interface{}, error)
+
+// change is the kind of change a listener is notified of.
+type change int
+
+const (
+	changeValue   change = iota // the value of the node was set
+	changeStatus                // the status of the value of the node was set
+	changeNode                  // a config or attribute of the node was set
+	changeAdded                 // the node was added to its parent
+	changeRemoved               // the node was removed from its parent
+)
+
+// Tree is the node tree of a responder. All nodes of a tree share a lock, so a node may be
+// used from any goroutine.
+type Tree struct {
+	mu        sync.RWMutex
+	root      *Node
+	profiles  map[string]Profile
+	listeners map[int]func(n *Node, c change)
+	nextId    int
+}
+
+// Node is a node of a Tree.
+type Node struct {
+	tree     *Tree
+	parent   *Node
+	name     string
+	path     string
+	configs  map[string]interface{}
+	attrs    map[string]interface{}
+	children map[string]*Node
+
+	value     interface{}
+	ts        time.Time
+	hasValue  bool
+	status    string
+	action    Action
+	onSet     SetHandler
+	transient bool
+}
+
+// NewTree returns a tree containing only its root node.
+func NewTree() *Tree {
+	t := &Tree{profiles: make(map[string]Profile), listeners: make(map[int]func(n *Node, c change))}
+	t.root = newNode(t, nil, "", "/")
+	t.root.configs["$is"] = "node"
+	return t
+}
+
+func newNode(t *Tree, parent *Node, name, path string) *Node {
+	return &Node{
+		tree:     t,
+		parent:   parent,
+		name:     name,
+		path:     path,
+		configs:  make(map[string]interface{}),
+		attrs:    make(map[string]interface{}),
+		children: make(map[string]*Node),
+	}
+}
+
+// Root returns the root node of the tree.
+func (t *Tree) Root() *Node {
+	return t.root
+}
+
+// Get returns the node at path, or nil if there is none.
+func (t *Tree) Get(path string) *Node {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := t.root
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// AddProfile registers the profile name. Nodes created or restored with name as their $is
+// config are initialized by p.
+func (t *Tree) AddProfile(name string, p Profile) {
+	t.mu.Lock()
+	t.profiles[name] = p
+	t.mu.Unlock()
+}
+
+// Profile returns the registered profile name.
+func (t *Tree) Profile(name string) (Profile, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.profiles[name]
+	return p, ok
+}
+
+// initialize applies the profile named by the $is config of n, if one is registered.
+// Must be called without t.mu held.
+func (t *Tree) initialize(n *Node) {
+	name := n.Profile()
+	if p, ok := t.Profile(name); ok {
+		p(n)
+	} else if name != "node" {
+		log.Warnf("No profile %q to initialize node %s", name, n.path)
+	}
+}
+
+// listen registers fn to be called after any node of the tree changes. The returned
+// function removes the listener.
+func (t *Tree) listen(fn func(n *Node, c change)) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := t.nextId
+	t.nextId++
+	t.listeners[id] = fn
+	return func() {
+		t.mu.Lock()
+		delete(t.listeners, id)
+		t.mu.Unlock()
+	}
+}
+
+// changed notifies listeners that n has changed. Must be called without t.mu held.
+func (t *Tree) changed(n *Node, c change) {
+	t.mu.RLock()
+	ls := make([]func(n *Node, c change), 0, len(t.listeners))
+	for _, fn := range t.listeners {
+		ls = append(ls, fn)
+	}
+	t.mu.RUnlock()
+
+	for _, fn := range ls {
+		fn(n, c)
+	}
+}
+
+// Config sets a config of a new node. The key must begin with $.
+func Config(key string, v interface{}) func(n *Node) {
+	return func(n *Node) {
+		n.configs[key] = v
+	}
+}
+
+// Attribute sets an attribute of a new node. The key must begin with @.
+func Attribute(key string, v interface{}) func(n *Node) {
+	return func(n *Node) {
+		n.attrs[key] = v
+	}
+}
+
+// Is sets the $is config of a new node, naming the profile which initializes it.
+func Is(profile string) func(n *Node) {
+	return Config("$is", profile)
+}
+
+// DisplayName sets the $name config of a new node.
+func DisplayName(name string) func(n *Node) {
+	return Config("$name", name)
+}
+
+// Type sets the $type config of a new node, making it a value node.
+func Type(typ string) func(n *Node) {
+	return Config("$type", typ)
+}
+
+// Value sets the initial value of a new node.
+func Value(v interface{}) func(n *Node) {
+	return func(n *Node) {
+		n.value = v
+		n.ts = time.Now()
+		n.hasValue = true
+	}
+}
+
+// Writable sets the $writable config of a new node, which is the permission required to
+// set its value: "write" or "config". Nodes without $writable, or with "never", may not
+// be set by requesters.
+func Writable(level string) func(n *Node) {
+	return Config("$writable", level)
+}
+
+// Invokable sets the $invokable config of a new node, which is the permission required to
+// invoke its action. Nodes with an action but no $invokable require "write".
+func Invokable(level string) func(n *Node) {
+	return Config("$invokable", level)
+}
+
+// OnSet sets the handler called when a set request writes to a new node.
+func OnSet(fn SetHandler) func(n *Node) {
+	return func(n *Node) {
+		n.onSet = fn
+	}
+}
+
+// OnInvoke sets the action called when a new node is invoked.
+func OnInvoke(fn Action) func(n *Node) {
+	return func(n *Node) {
+		n.action = fn
+	}
+}
+
+// Transient excludes a new node and its children from serialization. Use this for nodes
+// which are created by the link on every start.
+func Transient(n *Node) {
+	n.transient = true
+}
+
+// CreateChild creates a child of n with the specified name and options. If the child's $is
+// config names a registered profile, the profile is applied once the child is added to the
+// tree. Returns an error if the name is invalid or n already has a child with that name.
+func (n *Node) CreateChild(name string, opts ...func(n *Node)) (*Node, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	c := newNode(n.tree, n, name, conn.JoinPath(n.path, name))
+	c.configs["$is"] = "node"
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	n.tree.mu.Lock()
+	if _, ok := n.children[name]; ok {
+		n.tree.mu.Unlock()
+		return nil, fmt.Errorf("node %s already has a child named %q", n.path, name)
+	}
+	n.children[name] = c
+	n.tree.mu.Unlock()
+
+	n.tree.initialize(c)
+	n.tree.changed(c, changeAdded)
+	return c, nil
+}
+
+// RemoveChild removes the child of n named name. Returns false if there is no such child.
+func (n *Node) RemoveChild(name string) bool {
+	n.tree.mu.Lock()
+	c, ok := n.children[name]
+	delete(n.children, name)
+	n.tree.mu.Unlock()
+
+	if ok {
+		n.tree.changed(c, changeRemoved)
+	}
+	return ok
+}
+
+// Remove removes n from its parent.
+func (n *Node) Remove() bool {
+	if n.parent == nil {
+		return false
+	}
+	return n.parent.RemoveChild(n.name)
+}
+
+// Name returns the name of n, which is empty for the root node.
+func (n *Node) Name() string {
+	return n.name
+}
+
+// Path returns the path of n in its tree.
+func (n *Node) Path() string {
+	return n.path
+}
+
+// Parent returns the parent of n, or nil for the root node.
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// Child returns the child of n named name, or nil if there is none.
+func (n *Node) Child(name string) *Node {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	return n.children[name]
+}
+
+// Children returns the children of n sorted by name.
+func (n *Node) Children() []*Node {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	return n.sortedChildren()
+}
+
+func (n *Node) sortedChildren() []*Node {
+	cs := make([]*Node, 0, len(n.children))
+	for _, c := range n.children {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].name < cs[j].name })
+	return cs
+}
+
+// Profile returns the name of the profile of n, which is its $is config.
+func (n *Node) Profile() string {
+	is, _ := n.Config("$is")
+	name, _ := is.(string)
+	return name
+}
+
+// Config returns the config key of n, such as $type.
+func (n *Node) Config(key string) (interface{}, bool) {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	v, ok := n.configs[key]
+	return v, ok
+}
+
+// SetConfig sets the config key of n. A nil value removes the config.
+func (n *Node) SetConfig(key string, v interface{}) {
+	n.tree.mu.Lock()
+	if v == nil {
+		delete(n.configs, key)
+	} else {
+		n.configs[key] = v
+	}
+	n.tree.mu.Unlock()
+	n.tree.changed(n, changeNode)
+}
+
+// Attribute returns the attribute key of n, such as @unit.
+func (n *Node) Attribute(key string) (interface{}, bool) {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	v, ok := n.attrs[key]
+	return v, ok
+}
+
+// SetAttribute sets the attribute key of n. A nil value removes the attribute.
+func (n *Node) SetAttribute(key string, v interface{}) {
+	n.tree.mu.Lock()
+	if v == nil {
+		delete(n.attrs, key)
+	} else {
+		n.attrs[key] = v
+	}
+	n.tree.mu.Unlock()
+	n.tree.changed(n, changeNode)
+}
+
+// Value returns the value of n and the time it was set. The time is zero if n has no value.
+func (n *Node) Value() (interface{}, time.Time) {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	return n.value, n.ts
+}
+
+// SetValue sets the value of n, and its status to conn.StatusOk.
+func (n *Node) SetValue(v interface{}) {
+	n.tree.mu.Lock()
+	n.value = v
+	n.ts = time.Now()
+	n.hasValue = true
+	n.status = ""
+	n.tree.mu.Unlock()
+	n.tree.changed(n, changeValue)
+}
+
+// Status returns the status of the value of n, such as conn.StatusStale.
+func (n *Node) Status() string {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	if n.status == "" {
+		return conn.StatusOk
+	}
+	return n.status
+}
+
+// SetStatus sets the status of the value of n, without changing the value or its time.
+// Subscribers are sent the value with its new status.
+func (n *Node) SetStatus(status string) {
+	n.tree.mu.Lock()
+	changed := n.setStatus(status)
+	n.tree.mu.Unlock()
+
+	if changed {
+		n.tree.changed(n, changeStatus)
+	}
+}
+
+// MarkSubtree sets the status of n and all of its descendants, such as to
+// conn.StatusDisconnected when the device they represent is unreachable. Setting a value
+// resets the status of its node to conn.StatusOk.
+func (n *Node) MarkSubtree(status string) {
+	var changed []*Node
+	var mark func(n *Node)
+	mark = func(n *Node) {
+		if n.setStatus(status) {
+			changed = append(changed, n)
+		}
+		for _, c := range n.sortedChildren() {
+			mark(c)
+		}
+	}
+
+	n.tree.mu.Lock()
+	mark(n)
+	n.tree.mu.Unlock()
+
+	for _, c := range changed {
+		n.tree.changed(c, changeStatus)
+	}
+}
+
+// setStatus sets the status of n, returning whether the status of its value changed. Must
+// be called with n.tree.mu held.
+func (n *Node) setStatus(status string) bool {
+	if status == conn.StatusOk {
+		status = ""
+	}
+	if n.status == status {
+		return false
+	}
+	n.status = status
+	return n.hasValue
+}
+
+// level returns the permission named by the config key of n, such as $writable, or def if
+// n does not have the config or it does not name a permission.
+func (n *Node) level(key string, def conn.Permission) conn.Permission {
+	v, _ := n.Config(key)
+	s, _ := v.(string)
+	if p, ok := conn.ParsePermission(s); ok {
+		return p
+	}
+	return def
+}
+
+// setKey sets the attribute or config key of n.
+func (n *Node) setKey(key string, v interface{}) {
+	if strings.HasPrefix(key, "$") {
+		n.SetConfig(key, v)
+	} else {
+		n.SetAttribute(key, v)
+	}
+}
+
+// Writable returns the permission required to set the value of n, or conn.PermissionNever
+// if n is not writable.
+func (n *Node) Writable() conn.Permission {
+	return n.level("$writable", conn.PermissionNever)
+}
+
+// SetOnSet sets the handler called when a set request writes to n.
+func (n *Node) SetOnSet(fn SetHandler) {
+	n.tree.mu.Lock()
+	n.onSet = fn
+	n.tree.mu.Unlock()
+}
+
+// Write sets the value of n as requested by a set request. The value is checked against
+// the $type of n and passed to its SetHandler, which may transform or reject it. Write does
+// not check $writable, which is the responsibility of the caller.
+func (n *Node) Write(v interface{}) error {
+	n.tree.mu.RLock()
+	typ, _ := n.configs["$type"].(string)
+	fn := n.onSet
+	n.tree.mu.RUnlock()
+
+	v, err := CheckValue(typ, v)
+	if err != nil {
+		return err
+	}
+	if fn != nil {
+		if v, err = fn(n, v); err != nil {
+			return err
+		}
+	}
+
+	n.SetValue(v)
+	return nil
+}
+
+// SetAction sets the action called when n is invoked.
+func (n *Node) SetAction(fn Action) {
+	n.tree.mu.Lock()
+	n.action = fn
+	n.tree.mu.Unlock()
+}
+
+// Invoke calls the action of n with params.
+func (n *Node) Invoke(params map[string]interface{}) ([][]interface{}, error) {
+	n.tree.mu.RLock()
+	fn := n.action
+	n.tree.mu.RUnlock()
+
+	if fn == nil {
+		return nil, fmt.Errorf("node %s is not invokable", n.path)
+	}
+	return fn(n, params)
+}
+
+// validName returns an error if name may not be used as the name of a node.
+func validName(name string) error {
+	if name == "" {
+		return errors.New("node name is empty")
+	}
+	if strings.ContainsAny(name, "/\\?*:|<>,'\"") {
+		return fmt.Errorf("node name %q contains invalid characters", name)
+	}
+	if name[0] == '$' || name[0] == '@' {
+		return fmt.Errorf("node name %q may not begin with %c", name, name[0])
+	}
+	return nil
+}
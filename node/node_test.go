@@ -0,0 +1,213 @@
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/butlermatt/dslink/conn"
+)
+
+func TestNode_CreateChild(t *testing.T) {
+	tree := NewTree()
+	a, err := tree.Root().CreateChild("a", DisplayName("A"), Attribute("@unit", "C"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	b, _ := a.CreateChild("b", Type("number"), Value(1))
+
+	if b.Path() != "/a/b" || b.Parent() != a || b.Name() != "b" {
+		t.Errorf("Unexpected node: path=%q name=%q", b.Path(), b.Name())
+	}
+	if tree.Get("/a/b") != b || tree.Get("a/b/") != b || tree.Get("/") != tree.Root() {
+		t.Error("Tree.Get did not return expected nodes")
+	}
+	if tree.Get("/a/c") != nil {
+		t.Error("Tree.Get returned node for missing path")
+	}
+
+	if v, _ := a.Config("$name"); v != "A" {
+		t.Errorf("$name expected=%q got=%v", "A", v)
+	}
+	if v, _ := a.Config("$is"); v != "node" {
+		t.Errorf("$is expected=%q got=%v", "node", v)
+	}
+	if v, _ := a.Attribute("@unit"); v != "C" {
+		t.Errorf("@unit expected=%q got=%v", "C", v)
+	}
+	if v, ts := b.Value(); v != 1 || ts.IsZero() {
+		t.Errorf("Value expected=1 got=%v at %v", v, ts)
+	}
+
+	if _, err = a.CreateChild("b"); err == nil {
+		t.Error("Expected error creating duplicate child")
+	}
+	for _, name := range []string{"", "x/y", "$is", "@a", "q?"} {
+		if _, err = a.CreateChild(name); err == nil {
+			t.Errorf("Expected error creating child named %q", name)
+		}
+	}
+}
+
+func TestNode_Remove(t *testing.T) {
+	tree := NewTree()
+	a, _ := tree.Root().CreateChild("a")
+	_, _ = tree.Root().CreateChild("b")
+
+	if cs := tree.Root().Children(); len(cs) != 2 || cs[0] != a {
+		t.Errorf("Children expected sorted [a b] got=%v", cs)
+	}
+	if !a.Remove() || tree.Get("/a") != nil {
+		t.Error("Node was not removed")
+	}
+	if a.Remove() {
+		t.Error("Remove of removed node returned true")
+	}
+	if tree.Root().Remove() {
+		t.Error("Remove of root returned true")
+	}
+}
+
+func TestNode_Set(t *testing.T) {
+	tree := NewTree()
+	var changed []*Node
+	tree.listen(func(n *Node, _ change) { changed = append(changed, n) })
+
+	n, _ := tree.Root().CreateChild("n")
+	n.SetConfig("$type", "string")
+	n.SetAttribute("@a", 1)
+	n.SetValue("v")
+	n.SetAttribute("@a", nil)
+
+	if _, ok := n.Attribute("@a"); ok {
+		t.Error("Attribute was not removed")
+	}
+	if len(changed) != 5 {
+		t.Errorf("Listener calls expected=5 got=%d", len(changed))
+	}
+}
+
+func TestNode_Invoke(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", OnInvoke(func(n *Node, params map[string]interface{}) ([][]interface{}, error) {
+		if params["fail"] == true {
+			return nil, errors.New("failed")
+		}
+		return [][]interface{}{{n.Name(), params["a"]}}, nil
+	}))
+
+	rows, err := n.Invoke(map[string]interface{}{"a": 1})
+	if err != nil || len(rows) != 1 || rows[0][0] != "n" || rows[0][1] != 1 {
+		t.Errorf("Unexpected invoke result: %v %v", rows, err)
+	}
+	if _, err = n.Invoke(map[string]interface{}{"fail": true}); err == nil {
+		t.Error("Expected action error")
+	}
+
+	m, _ := tree.Root().CreateChild("m")
+	if _, err = m.Invoke(nil); err == nil {
+		t.Error("Expected error invoking node without action")
+	}
+}
+
+func TestTree_Profile(t *testing.T) {
+	tree := NewTree()
+	var initialized []string
+	tree.AddProfile("device", func(n *Node) {
+		initialized = append(initialized, n.Path())
+		n.SetAction(func(n *Node, _ map[string]interface{}) ([][]interface{}, error) {
+			return [][]interface{}{{n.Profile()}}, nil
+		})
+	})
+
+	d, _ := tree.Root().CreateChild("d", Is("device"))
+	if len(initialized) != 1 || initialized[0] != "/d" {
+		t.Errorf("Profile was not applied on create: %v", initialized)
+	}
+	if rows, err := d.Invoke(nil); err != nil || rows[0][0] != "device" {
+		t.Errorf("Profile action unexpected result: %v %v", rows, err)
+	}
+
+	if p, _ := tree.Root().CreateChild("p"); p.Profile() != "node" {
+		t.Errorf("Default profile expected=%q got=%q", "node", p.Profile())
+	}
+	if _, ok := tree.Profile("missing"); ok {
+		t.Error("Missing profile was found")
+	}
+}
+
+func TestNode_Write(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Type(Enum("low", "high")), Writable("write"),
+		OnSet(func(n *Node, v interface{}) (interface{}, error) {
+			if v == "high" {
+				return nil, errors.New("too high")
+			}
+			return v, nil
+		}))
+
+	if n.Writable() != conn.PermissionWrite {
+		t.Errorf("Writable expected=%v got=%v", conn.PermissionWrite, n.Writable())
+	}
+	if err := n.Write("low"); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if v, _ := n.Value(); v != "low" {
+		t.Errorf("Value expected=%q got=%v", "low", v)
+	}
+	if err := n.Write("mid"); err == nil {
+		t.Error("Expected error writing invalid enum value")
+	}
+	if err := n.Write("high"); err == nil {
+		t.Error("Expected error from set handler")
+	}
+	if v, _ := n.Value(); v != "low" {
+		t.Errorf("Rejected write changed value to %v", v)
+	}
+
+	m, _ := tree.Root().CreateChild("m", Writable("never"))
+	if m.Writable() != conn.PermissionNever {
+		t.Errorf("Writable of never expected=%v got=%v", conn.PermissionNever, m.Writable())
+	}
+	if o, _ := tree.Root().CreateChild("o"); o.Writable() != conn.PermissionNever {
+		t.Errorf("Writable without $writable expected=%v got=%v", conn.PermissionNever, o.Writable())
+	}
+}
+
+func TestNode_MarkSubtree(t *testing.T) {
+	tree := NewTree()
+	plc, _ := tree.Root().CreateChild("plc")
+	a, _ := plc.CreateChild("a", Value(1))
+	b, _ := plc.CreateChild("b", Value(2))
+	other, _ := tree.Root().CreateChild("other", Value(3))
+
+	var changed []string
+	tree.listen(func(n *Node, c change) {
+		if c == changeStatus {
+			changed = append(changed, n.Path())
+		}
+	})
+
+	plc.MarkSubtree(conn.StatusDisconnected)
+	if a.Status() != conn.StatusDisconnected || b.Status() != conn.StatusDisconnected || other.Status() != conn.StatusOk {
+		t.Errorf("Unexpected statuses a=%s b=%s other=%s", a.Status(), b.Status(), other.Status())
+	}
+	if len(changed) != 2 || changed[0] != "/plc/a" || changed[1] != "/plc/b" {
+		t.Errorf("Status changes expected=[/plc/a /plc/b] got=%v", changed)
+	}
+
+	// Marking again with the same status does not notify.
+	changed = nil
+	plc.MarkSubtree(conn.StatusDisconnected)
+	if len(changed) != 0 {
+		t.Errorf("Unchanged status notified: %v", changed)
+	}
+
+	a.SetValue(4)
+	if a.Status() != conn.StatusOk {
+		t.Errorf("Status after SetValue expected=%s got=%s", conn.StatusOk, a.Status())
+	}
+	b.SetStatus(conn.StatusStale)
+	if v, _ := b.Value(); v != 2 || b.Status() != conn.StatusStale {
+		t.Errorf("Unexpected value after SetStatus: %v %s", v, b.Status())
+	}
+}
@@ -0,0 +1,237 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/internal/fsutil"
+	"github.com/butlermatt/dslink/log"
+)
+
+// DefaultQueueSize is the default number of updates queued for a subscription.
+const DefaultQueueSize = 1000
+
+// Subscription QoS levels.
+const (
+	QosLatest  = 0 // only the latest value is sent
+	QosQueue   = 1 // updates are queued and sent in order
+	QosDurable = 2 // as QosQueue, and the queue survives a disconnect
+	QosStored  = 3 // as QosDurable, and the queue is persisted to disk
+)
+
+// update is a queued subscription update. An update which has been merged with earlier
+// updates has a Count, and aggregates their values if they were all numbers. An update of
+// only the status of the value is not counted as an update of the value.
+type update struct {
+	Value      interface{} `json:"value"`
+	Ts         string      `json:"ts"`
+	Status     string      `json:"status,omitempty"`
+	StatusOnly bool        `json:"statusOnly,omitempty"`
+	Count      int         `json:"count,omitempty"`
+	Sum        *float64    `json:"sum,omitempty"`
+	Min        *float64    `json:"min,omitempty"`
+	Max        *float64    `json:"max,omitempty"`
+}
+
+// merge returns u merged with the earlier update prev. The merged update has the value,
+// ts and status of u, and the count, sum, min and max of both. Updates of only the status
+// are not counted: merging one sets the status of the other.
+func (u update) merge(prev update) update {
+	switch {
+	case prev.StatusOnly:
+		return u
+	case u.StatusOnly:
+		prev.Status = u.Status
+		return prev
+	}
+
+	a, b := prev.aggregate(), u.aggregate()
+	m := update{Value: u.Value, Ts: u.Ts, Status: u.Status, Count: a.Count + b.Count}
+	if a.Sum != nil && b.Sum != nil {
+		sum, min, max := *a.Sum+*b.Sum, math.Min(*a.Min, *b.Min), math.Max(*a.Max, *b.Max)
+		m.Sum, m.Min, m.Max = &sum, &min, &max
+	}
+	return m
+}
+
+// aggregate returns u with its count and aggregation set, as an update merged from itself.
+func (u update) aggregate() update {
+	if u.Count > 0 {
+		return u
+	}
+	u.Count = 1
+	if f, ok := conn.Float64(u.Value); ok {
+		u.Sum, u.Min, u.Max = &f, &f, &f
+	}
+	return u
+}
+
+// encode returns u as a subscription update of sid. Merged updates, and updates of values
+// which are not ok, are encoded as maps, which carry their aggregation and status.
+func (u update) encode(sid int32) interface{} {
+	if u.Count == 0 && u.Status == "" {
+		return []interface{}{sid, u.Value, u.Ts}
+	}
+
+	m := map[string]interface{}{"sid": sid, "value": u.Value, "ts": u.Ts}
+	if u.Status != "" {
+		m["status"] = u.Status
+	}
+	if u.Count > 0 {
+		m["count"] = u.Count
+	}
+	if u.Sum != nil {
+		m["sum"], m["min"], m["max"] = *u.Sum, *u.Min, *u.Max
+	}
+	return m
+}
+
+// subscription is a subscription to the value of a node, with the updates not yet sent.
+type subscription struct {
+	Sid   int32    `json:"sid"`
+	Path  string   `json:"path"`
+	Qos   int      `json:"qos"`
+	Queue []update `json:"queue,omitempty"`
+
+	// kept is set for a subscription kept over a reconnect, until the broker renews it.
+	kept bool
+}
+
+// push queues u according to the qos of s. Subscriptions with QosLatest merge u with the
+// update already queued, and others keep at most max updates, merging the oldest into the
+// next when the queue is full.
+func (s *subscription) push(u update, max int) {
+	if s.Qos <= QosLatest {
+		if len(s.Queue) > 0 {
+			u = u.merge(s.Queue[0])
+		}
+		s.Queue = append(s.Queue[:0], u)
+		return
+	}
+
+	s.Queue = append(s.Queue, u)
+	for max > 0 && len(s.Queue) > max && len(s.Queue) > 1 {
+		s.Queue[1] = s.Queue[1].merge(s.Queue[0])
+		s.Queue = append(s.Queue[:0], s.Queue[1:]...)
+	}
+}
+
+// QueueSize sets the number of updates queued for each subscription with a qos of 1 or more
+// while the Responder is paused. When the queue is full, the oldest update is merged into
+// the next.
+func QueueSize(n int) func(r *Responder) {
+	return func(r *Responder) {
+		r.queueSize = n
+	}
+}
+
+// QueueFile sets the file the subscriptions with qos 3, and their queued updates, are
+// persisted to, so they survive a restart of the link.
+func QueueFile(path string) func(r *Responder) {
+	return func(r *Responder) {
+		r.queueFile = path
+	}
+}
+
+// QueueDebounce saves the queue file at most once per d after the subscriptions with qos 3
+// change. A d of 0 saves on every change. The default is one second.
+func QueueDebounce(d time.Duration) func(r *Responder) {
+	return func(r *Responder) {
+		r.queueDebounce = d
+	}
+}
+
+// loadQueue restores the subscriptions persisted to the queue file.
+func (r *Responder) loadQueue() {
+	b, err := ioutil.ReadFile(r.queueFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warnf("Unable to read subscription queue: %v", err)
+		return
+	}
+
+	var subs []*subscription
+	if err = json.Unmarshal(b, &subs); err != nil {
+		log.Warnf("Unable to decode subscription queue %q: %v", r.queueFile, err)
+		return
+	}
+	for _, s := range subs {
+		s.kept = true
+		r.subs[s.Sid] = s
+		r.stored = r.stored || len(s.Queue) > 0
+	}
+}
+
+// saveQueue schedules the subscriptions with QosStored to be persisted to the queue file.
+// Must be called with r.mu held.
+func (r *Responder) saveQueue() {
+	if r.queueFile == "" {
+		return
+	}
+
+	r.stored = false
+	for _, s := range r.subs {
+		r.stored = r.stored || (s.Qos >= QosStored && len(s.Queue) > 0)
+	}
+	select {
+	case r.saves <- struct{}{}:
+	default:
+	}
+}
+
+// writeQueue persists the subscriptions with QosStored to the queue file.
+func (r *Responder) writeQueue() {
+	r.mu.Lock()
+	subs := make([]*subscription, 0)
+	for _, s := range r.subs {
+		if s.Qos >= QosStored {
+			subs = append(subs, s)
+		}
+	}
+	b, err := json.Marshal(subs)
+	r.mu.Unlock()
+
+	if err == nil {
+		err = fsutil.WriteFileAtomic(r.queueFile, b, 0644)
+	}
+	if err != nil {
+		log.Warnf("Unable to save subscription queue: %v", err)
+	}
+}
+
+// runQueue saves the queue file when saveQueue is called, until the Responder is closed.
+func (r *Responder) runQueue() {
+	defer r.wg.Done()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-r.saves:
+			if r.queueDebounce > 0 {
+				if debounce == nil {
+					debounce = time.After(r.queueDebounce)
+				}
+				continue
+			}
+		case <-debounce:
+		case <-r.done:
+			if debounce != nil {
+				// Leave a pending save for Close.
+				select {
+				case r.saves <- struct{}{}:
+				default:
+				}
+			}
+			return
+		}
+
+		debounce = nil
+		r.writeQueue()
+	}
+}
@@ -0,0 +1,308 @@
+package node
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+)
+
+func TestSubscription_Push(t *testing.T) {
+	s := &subscription{Qos: QosLatest}
+	s.push(update{Value: 1}, 2)
+	s.push(update{Value: 2}, 2)
+	if len(s.Queue) != 1 || s.Queue[0].Value != 2 || s.Queue[0].Count != 2 {
+		t.Errorf("Qos 0 queue expected latest only got=%v", s.Queue)
+	}
+
+	s = &subscription{Qos: QosQueue}
+	for i := 1; i <= 3; i++ {
+		s.push(update{Value: i}, 2)
+	}
+	if len(s.Queue) != 2 || s.Queue[0].Value != 2 || s.Queue[0].Count != 2 || s.Queue[1].Value != 3 {
+		t.Errorf("Qos 1 queue expected [2 3] got=%v", s.Queue)
+	}
+}
+
+func TestUpdate_Merge(t *testing.T) {
+	u := update{Value: 4.0, Ts: "a"}
+	for _, v := range []interface{}{-1, 7.5, int8(2)} {
+		u = update{Value: v, Ts: "b"}.merge(u)
+	}
+	if u.Value != int8(2) || u.Ts != "b" || u.Count != 4 || *u.Sum != 12.5 || *u.Min != -1 || *u.Max != 7.5 {
+		t.Errorf("Unexpected merged update: %+v", u)
+	}
+
+	u = update{Value: "on"}.merge(u)
+	if u.Count != 5 || u.Sum != nil {
+		t.Errorf("Merged non-numeric update expected count only got=%+v", u)
+	}
+
+	// Updates of only the status are not counted.
+	u = update{Value: "on", Status: "stale", StatusOnly: true}.merge(u)
+	if u.Count != 5 || u.Status != "stale" || u.StatusOnly {
+		t.Errorf("Merged status update expected count=5 status=stale got=%+v", u)
+	}
+	u = update{Value: 2.0}.merge(update{Value: 1.0, Status: "stale", StatusOnly: true})
+	if u.Count != 0 || u.Status != "" || u.Sum != nil {
+		t.Errorf("Update merged with status update expected unmerged update got=%+v", u)
+	}
+
+	if row, ok := (update{Value: 1, Ts: "t"}).encode(3).([]interface{}); !ok || len(row) != 3 {
+		t.Errorf("Unmerged update expected row got=%v", row)
+	}
+}
+
+// sentUpdates returns the subscription updates for sid in resps.
+func sentUpdates(t *testing.T, resps []*conn.Response, sid int32) []conn.ValueUpdate {
+	t.Helper()
+	var vus []conn.ValueUpdate
+	for _, resp := range resps {
+		for _, u := range resp.Updates {
+			vu, err := conn.ParseValueUpdate(u)
+			if err != nil {
+				t.Fatal("Unexpected error", err)
+			}
+			if vu.Sid == sid {
+				vus = append(vus, vu)
+			}
+		}
+	}
+	return vus
+}
+
+// sent returns the values of the subscription updates for sid in resps.
+func sent(resps []*conn.Response, sid int32) []interface{} {
+	var vs []interface{}
+	for _, resp := range resps {
+		for _, u := range resp.Updates {
+			if vu, err := conn.ParseValueUpdate(u); err == nil && vu.Sid == sid {
+				vs = append(vs, vu.Value)
+			}
+		}
+	}
+	return vs
+}
+
+func subscribe(r *testResponder, sid int32, path string, qos int) []*conn.Response {
+	r.Handle(&conn.Request{Rid: sid, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: path, Sid: sid, Qos: qos}}})
+	return r.take()
+}
+
+func TestResponder_Pause(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(0.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	for qos := QosLatest; qos <= QosDurable; qos++ {
+		subscribe(r, int32(qos+1), "/n", qos)
+	}
+
+	r.Pause()
+	for _, v := range []float64{1, 2, 3} {
+		n.SetValue(v)
+	}
+	if resps := r.take(); len(resps) != 0 {
+		t.Fatalf("Paused responder sent updates: %+v", resps)
+	}
+
+	r.Resume()
+	resps := r.take()
+	if vus := sentUpdates(t, resps, 1); len(vus) != 1 || vus[0].Value != 3.0 {
+		t.Errorf("Qos 0 updates expected=[3] got=%v", vus)
+	} else if vu := vus[0]; vu.Count != 3 || vu.Sum == nil || *vu.Sum != 6 || *vu.Min != 1 || *vu.Max != 3 {
+		t.Errorf("Coalesced update expected count=3 sum=6 min=1 max=3 got=%+v", vu)
+	}
+	for sid := int32(2); sid <= 3; sid++ {
+		if vs := sent(resps, sid); !reflect.DeepEqual(vs, []interface{}{1.0, 2.0, 3.0}) {
+			t.Errorf("Qos %d updates expected=[1 2 3] got=%v", sid-1, vs)
+		}
+	}
+}
+
+func TestResponder_PauseStatus(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(1.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+	subscribe(r, 1, "/n", QosLatest)
+	subscribe(r, 2, "/n", QosQueue)
+
+	// A status change is not merged as another value.
+	r.Pause()
+	n.SetStatus(conn.StatusStale)
+	n.SetValue(2.0)
+	r.Resume()
+	resps := r.take()
+	if vus := sentUpdates(t, resps, 1); len(vus) != 1 || vus[0].Value != 2.0 || vus[0].Count != 0 || vus[0].Status != conn.StatusOk {
+		t.Errorf("Qos 0 update expected unmerged 2 got=%+v", vus)
+	}
+	if vus := sentUpdates(t, resps, 2); len(vus) != 2 || vus[0].Status != conn.StatusStale || vus[1].Value != 2.0 {
+		t.Errorf("Qos 1 updates expected [1 stale, 2] got=%+v", vus)
+	}
+
+	r.Pause()
+	n.SetValue(3.0)
+	n.SetValue(4.0)
+	n.SetStatus(conn.StatusStale)
+	r.Resume()
+	vus := sentUpdates(t, r.take(), 1)
+	if len(vus) != 1 || vus[0].Status != conn.StatusStale || vus[0].Count != 2 || vus[0].Sum == nil || *vus[0].Sum != 7 {
+		t.Errorf("Qos 0 update expected stale count=2 sum=7 got=%+v", vus)
+	}
+}
+
+func TestResponder_ResumeOrder(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(0.0))
+
+	// A slow send lets a concurrent change overtake the updates flushed by Resume, unless
+	// sends are serialized.
+	var mu sync.Mutex
+	var resps []*conn.Response
+	r := NewResponder(tree, func(resp *conn.Response) {
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		mu.Lock()
+		resps = append(resps, resp)
+		mu.Unlock()
+	})
+	defer r.Close()
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/n", Sid: 1, Qos: QosQueue}}})
+
+	const count = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= count; i++ {
+			n.SetValue(float64(i))
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+		}
+	}()
+	for resuming := true; resuming; {
+		select {
+		case <-done:
+			resuming = false
+		default:
+		}
+		r.Pause()
+		time.Sleep(10 * time.Microsecond)
+		r.Resume()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	vs := sent(resps, 1)
+	if len(vs) != count+1 {
+		t.Fatalf("Expected %d updates got=%d", count+1, len(vs))
+	}
+	for i, v := range vs {
+		if v != float64(i) {
+			t.Fatalf("Update %d expected=%d got=%v", i, i, v)
+		}
+	}
+}
+
+func TestResponder_Disconnected(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(0.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	subscribe(r, 1, "/n", QosQueue)
+	subscribe(r, 2, "/n", QosDurable)
+
+	r.Disconnected()
+	n.SetValue(1.0)
+	n.SetValue(2.0)
+
+	// The broker renews its subscriptions when the link reconnects.
+	resps := subscribe(r, 2, "/n", QosDurable)
+	resps = append(resps, subscribe(r, 1, "/n", QosQueue)...)
+	r.Resume()
+	resps = append(resps, r.take()...)
+
+	if vs := sent(resps, 1); !reflect.DeepEqual(vs, []interface{}{2.0}) {
+		t.Errorf("Dropped qos 1 subscription expected current value got=%v", vs)
+	}
+	if vs := sent(resps, 2); !reflect.DeepEqual(vs, []interface{}{1.0, 2.0}) {
+		t.Errorf("Qos 2 updates expected=[1 2] got=%v", vs)
+	}
+}
+
+func TestResponder_RenewedSid(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(0.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+	subscribe(r, 1, "/n", QosDurable)
+
+	r.Disconnected()
+	n.SetValue(1.0)
+
+	// A broker renewing the subscription with a new sid receives its queued updates, and the
+	// old sid is dropped.
+	resps := subscribe(r, 7, "/n", QosDurable)
+	r.Resume()
+	resps = append(resps, r.take()...)
+	if vs := sent(resps, 7); !reflect.DeepEqual(vs, []interface{}{1.0}) {
+		t.Errorf("Renewed updates expected=[1] got=%v", vs)
+	}
+	if _, ok := r.subs[1]; ok || len(r.subs) != 1 {
+		t.Errorf("Old sid was kept: %v", r.subs)
+	}
+}
+
+func TestResponder_QueueFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Value(0.0))
+
+	r := newTestResponder(tree, QueueFile(path), QueueSize(2))
+	subscribe(r, 1, "/n", QosStored)
+	subscribe(r, 2, "/n", QosDurable)
+
+	r.Disconnected()
+	for _, v := range []float64{1, 2, 3} {
+		n.SetValue(v)
+	}
+	r.Close()
+
+	// A new responder restores the stored subscription and its bounded queue.
+	r = newTestResponder(tree, QueueFile(path))
+	defer r.Close()
+
+	resps := subscribe(r, 1, "/n", QosStored)
+	if vs := sent(resps, 1); !reflect.DeepEqual(vs, []interface{}{2.0, 3.0}) {
+		t.Errorf("Stored updates expected=[2 3] got=%v", vs)
+	}
+	if vs := sent(resps, 2); len(vs) != 0 {
+		t.Errorf("Qos 2 subscription was persisted: %v", vs)
+	}
+
+	// Sent updates are removed from the file.
+	r.Close()
+	r = newTestResponder(tree, QueueFile(path))
+	defer r.Close()
+	if resps = subscribe(r, 1, "/n", QosStored); !reflect.DeepEqual(sent(resps, 1), []interface{}{3.0}) {
+		t.Errorf("Resent stored updates: %v", sent(resps, 1))
+	}
+
+	// Changes are saved after the debounce, without closing the responder.
+	r.Close()
+	r = newTestResponder(tree, QueueFile(path), QueueDebounce(10*time.Millisecond))
+	defer r.Close()
+	subscribe(r, 1, "/n", QosStored)
+	r.Disconnected()
+	n.SetValue(4.0)
+	time.Sleep(100 * time.Millisecond)
+	if b, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(b), `"value":4`) {
+		t.Errorf("Queue file was not saved after the debounce: %s %v", b, err)
+	}
+}
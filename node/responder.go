@@ -0,0 +1,564 @@
+package node
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/log"
+)
+
+// Responder handles the requests of a broker for the nodes of a Tree. Responses, including
+// subscription updates, are passed to its send function to be written to the broker.
+type Responder struct {
+	tree   *Tree
+	send   func(resp *conn.Response)
+	cancel func()
+
+	queueSize     int
+	queueFile     string
+	queueDebounce time.Duration
+	saves         chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+	once          sync.Once
+
+	mu     sync.Mutex
+	lists  map[int32]*listStream   // open list streams by rid
+	subs   map[int32]*subscription // subscriptions by sid
+	paused bool
+	stored bool // whether the queue file holds updates not yet sent
+
+	// smu serializes calls to send. It is acquired before r.mu is released, so responses
+	// are sent in the order they were built.
+	smu sync.Mutex
+}
+
+// listStream is an open list request.
+type listStream struct {
+	rid  int32
+	path string
+	keys map[string]bool // configs and attributes last sent
+}
+
+// NewResponder returns a Responder for the nodes of t. The send function is called with each
+// response, one at a time and in order. It must not block for long or change the tree, as it
+// may be called while a node is being changed. Options may be passed to configure the
+// queueing of subscription updates.
+func NewResponder(t *Tree, send func(resp *conn.Response), opts ...func(r *Responder)) *Responder {
+	r := &Responder{
+		tree:          t,
+		send:          send,
+		queueSize:     DefaultQueueSize,
+		queueDebounce: time.Second,
+		saves:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		lists:         make(map[int32]*listStream),
+		subs:          make(map[int32]*subscription),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.queueFile != "" {
+		r.loadQueue()
+		r.wg.Add(1)
+		go r.runQueue()
+	}
+	r.cancel = t.listen(r.changed)
+	return r
+}
+
+// Close stops the Responder sending updates for changes to the tree, and saves any unsaved
+// changes to the queue file.
+func (r *Responder) Close() {
+	r.once.Do(func() {
+		r.cancel()
+		close(r.done)
+	})
+	r.wg.Wait()
+
+	select {
+	case <-r.saves:
+		r.writeQueue()
+	default:
+	}
+}
+
+// Pause queues subscription updates instead of sending them, such as while the link is
+// throttled or disconnected from the broker. Each subscription queues updates according to
+// its qos.
+func (r *Responder) Pause() {
+	r.mu.Lock()
+	r.paused = true
+	r.mu.Unlock()
+}
+
+// Resume sends the updates queued while the Responder was paused, and resumes sending
+// updates as values change.
+func (r *Responder) Resume() {
+	r.mu.Lock()
+	r.paused = false
+	if updates := r.flush(); len(updates) > 0 {
+		r.unlockSend(&conn.Response{Updates: updates})
+	} else {
+		r.mu.Unlock()
+	}
+}
+
+// Disconnected pauses the Responder when the link loses its connection to the broker. List
+// streams and subscriptions with a qos below 2 are dropped, as the broker renews them when
+// the link reconnects. The broker may renew a kept subscription with a new sid, which
+// replaces the old one. Call Resume once the link has reconnected.
+func (r *Responder) Disconnected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.paused = true
+	r.lists = make(map[int32]*listStream)
+	for sid, s := range r.subs {
+		if s.Qos < QosDurable {
+			delete(r.subs, sid)
+		} else {
+			s.kept = true
+		}
+	}
+}
+
+// Handle handles a request from the broker. The permit of the request, if any, limits its
+// permission, which must meet the $writable or $invokable level of the node it targets.
+func (r *Responder) Handle(req *conn.Request) {
+	switch req.Method {
+	case conn.MethodList:
+		r.list(req)
+	case conn.MethodSubscribe:
+		r.subscribe(req)
+	case conn.MethodUnsubscribe:
+		r.mu.Lock()
+		stored := false
+		for _, sid := range req.Sids {
+			if s, ok := r.subs[sid]; ok {
+				stored = stored || s.Qos >= QosStored
+				delete(r.subs, sid)
+			}
+		}
+		if stored {
+			r.saveQueue()
+		}
+		r.unlockSend(conn.ClosedResponse(req.Rid, nil))
+	case conn.MethodSet:
+		r.reply(conn.ClosedResponse(req.Rid, r.set(req)))
+	case conn.MethodRemove:
+		r.reply(conn.ClosedResponse(req.Rid, r.remove(req)))
+	case conn.MethodInvoke:
+		r.invoke(req)
+	case conn.MethodClose:
+		r.mu.Lock()
+		delete(r.lists, req.Rid)
+		r.mu.Unlock()
+	default:
+		r.reply(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrInvalidMethod, "unknown method %q", req.Method)))
+	}
+}
+
+func (r *Responder) list(req *conn.Request) {
+	path := conn.CleanPath(req.Path)
+	if !permission(req).Allows(conn.PermissionList) {
+		r.reply(conn.ClosedResponse(req.Rid, denied(req.Method, path)))
+		return
+	}
+	n := r.tree.Get(path)
+	if n == nil {
+		r.reply(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrInvalidPath, "no node at %s", path)))
+		return
+	}
+
+	ls := &listStream{rid: req.Rid, path: path, keys: make(map[string]bool)}
+	r.mu.Lock()
+	r.lists[req.Rid] = ls
+	r.unlockSend(&conn.Response{Rid: req.Rid, Stream: conn.StreamOpen, Updates: r.listUpdates(ls, n)})
+}
+
+func (r *Responder) subscribe(req *conn.Request) {
+	if !permission(req).Allows(conn.PermissionRead) {
+		r.reply(conn.ClosedResponse(req.Rid, denied(req.Method, "paths")))
+		return
+	}
+
+	r.mu.Lock()
+	stored := false
+	for _, p := range req.Paths {
+		if p == nil {
+			continue
+		}
+		path := conn.CleanPath(p.Path)
+		s, ok := r.subs[p.Sid]
+		if !ok || s.Path != path {
+			if kept := r.kept(path); kept != nil {
+				delete(r.subs, kept.Sid)
+				kept.Sid = p.Sid
+				s, ok = kept, true
+			}
+		}
+		if ok {
+			stored = stored || s.Qos >= QosStored
+			s.kept = false
+		}
+
+		if ok && s.Path == path && len(s.Queue) > 0 {
+			// The updates queued for a renewed subscription are sent instead of the value.
+			s.Qos = p.Qos
+			r.subs[s.Sid] = s
+		} else {
+			s = &subscription{Sid: p.Sid, Path: path, Qos: p.Qos}
+			r.subs[s.Sid] = s
+			if n := r.tree.Get(path); n != nil {
+				if u, ok := valueOf(n); ok {
+					s.push(u, r.queueSize)
+				}
+			}
+		}
+		stored = stored || s.Qos >= QosStored
+	}
+	if stored {
+		r.saveQueue()
+	}
+	var resps []*conn.Response
+	if updates := r.flush(); len(updates) > 0 {
+		resps = append(resps, &conn.Response{Updates: updates})
+	}
+	r.unlockSend(append(resps, conn.ClosedResponse(req.Rid, nil))...)
+}
+
+// kept returns the subscription to path kept over a reconnect, or nil. Must be called with
+// r.mu held.
+func (r *Responder) kept(path string) *subscription {
+	for _, s := range r.subs {
+		if s.kept && s.Path == path {
+			return s
+		}
+	}
+	return nil
+}
+
+// set handles a set request for the value, an attribute or a config of a node.
+func (r *Responder) set(req *conn.Request) *conn.Error {
+	path := conn.CleanPath(req.Path)
+	if name := lastName(path); isKey(name) {
+		n, err := r.keyNode(req, path)
+		if err != nil {
+			return err
+		}
+		n.setKey(name, req.Value)
+		return nil
+	}
+
+	n := r.tree.Get(path)
+	if n == nil {
+		return conn.NewError(conn.ErrInvalidPath, "no node at %s", path)
+	}
+	required := n.Writable()
+	if required == conn.PermissionNever {
+		return conn.NewError(conn.ErrPermissionDenied, "%s is not writable", path)
+	}
+	if !permission(req).Allows(required) {
+		return denied(req.Method, path)
+	}
+
+	return responseError(n.Write(req.Value))
+}
+
+// remove handles a remove request for an attribute or a config of a node.
+func (r *Responder) remove(req *conn.Request) *conn.Error {
+	path := conn.CleanPath(req.Path)
+	name := lastName(path)
+	if !isKey(name) {
+		return conn.NewError(conn.ErrInvalidPath, "%s is not an attribute or config", path)
+	}
+
+	n, err := r.keyNode(req, path)
+	if err != nil {
+		return err
+	}
+	n.setKey(name, nil)
+	return nil
+}
+
+// keyNode returns the node of the attribute or config at path, checking that req has the
+// permission to change it. Attributes require write and configs require config.
+func (r *Responder) keyNode(req *conn.Request, path string) (*Node, *conn.Error) {
+	required := conn.PermissionWrite
+	if strings.HasPrefix(lastName(path), "$") {
+		required = conn.PermissionConfig
+	}
+	if !permission(req).Allows(required) {
+		return nil, denied(req.Method, path)
+	}
+
+	n := r.tree.Get(conn.ParentPath(path))
+	if n == nil {
+		return nil, conn.NewError(conn.ErrInvalidPath, "no node at %s", conn.ParentPath(path))
+	}
+	return n, nil
+}
+
+func (r *Responder) invoke(req *conn.Request) {
+	path := conn.CleanPath(req.Path)
+	n := r.tree.Get(path)
+	if n == nil {
+		r.reply(conn.ClosedResponse(req.Rid, conn.NewError(conn.ErrInvalidPath, "no node at %s", path)))
+		return
+	}
+	if !permission(req).Allows(n.level("$invokable", conn.PermissionWrite)) {
+		r.reply(conn.ClosedResponse(req.Rid, denied(req.Method, path)))
+		return
+	}
+
+	rows, err := n.Invoke(req.Params)
+	if err != nil {
+		r.reply(conn.ClosedResponse(req.Rid, responseError(err)))
+		return
+	}
+
+	resp := &conn.Response{Rid: req.Rid, Stream: conn.StreamClosed}
+	if cols, ok := n.Config("$columns"); ok {
+		resp.Columns = columns(path, cols)
+	}
+	for _, row := range rows {
+		resp.Updates = append(resp.Updates, row)
+	}
+	r.reply(resp)
+}
+
+// changed sends list and subscription updates for a change to the tree.
+func (r *Responder) changed(n *Node, c change) {
+	var resps []*conn.Response
+
+	r.mu.Lock()
+	switch c {
+	case changeValue, changeStatus:
+		u, ok := valueOf(n)
+		if !ok {
+			break
+		}
+		u.StatusOnly = c == changeStatus
+		stored := false
+		for _, s := range r.subs {
+			if s.Path == n.path {
+				s.push(u, r.queueSize)
+				stored = stored || s.Qos >= QosStored
+			}
+		}
+		if r.paused {
+			if stored {
+				r.saveQueue()
+			}
+		} else if updates := r.flush(); len(updates) > 0 {
+			resps = append(resps, &conn.Response{Updates: updates})
+		}
+	case changeNode:
+		for _, ls := range r.lists {
+			if ls.path == n.path {
+				resps = append(resps, &conn.Response{Rid: ls.rid, Stream: conn.StreamOpen, Updates: r.listUpdates(ls, n)})
+			}
+		}
+		resps = append(resps, r.childUpdates(n, []interface{}{n.name, childSummary(n)})...)
+	case changeAdded:
+		resps = append(resps, r.childUpdates(n, []interface{}{n.name, childSummary(n)})...)
+	case changeRemoved:
+		resps = append(resps, r.childUpdates(n, map[string]interface{}{"name": n.name, "change": "remove"})...)
+	}
+	r.unlockSend(resps...)
+}
+
+// unlockSend releases r.mu and sends resps, before any responses built after it is released.
+func (r *Responder) unlockSend(resps ...*conn.Response) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+	r.mu.Unlock()
+
+	for _, resp := range resps {
+		r.send(resp)
+	}
+}
+
+// reply sends resp, which does not depend on the state of the Responder.
+func (r *Responder) reply(resp *conn.Response) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+	r.send(resp)
+}
+
+// flush returns the queued updates of all subscriptions, in order for each subscription,
+// and clears the queues. Returns nil if the Responder is paused. Must be called with r.mu held.
+func (r *Responder) flush() []interface{} {
+	if r.paused {
+		return nil
+	}
+
+	var updates []interface{}
+	for _, s := range r.subs {
+		for _, u := range s.Queue {
+			updates = append(updates, u.encode(s.Sid))
+		}
+		s.Queue = nil
+	}
+	if r.stored {
+		r.saveQueue()
+	}
+	return updates
+}
+
+// childUpdates returns the responses to the list streams of the parent of n for an update
+// of n. Must be called with r.mu held.
+func (r *Responder) childUpdates(n *Node, update interface{}) []*conn.Response {
+	if n.parent == nil {
+		return nil
+	}
+
+	var resps []*conn.Response
+	for _, ls := range r.lists {
+		if ls.path == n.parent.path {
+			resps = append(resps, &conn.Response{Rid: ls.rid, Stream: conn.StreamOpen, Updates: []interface{}{update}})
+		}
+	}
+	return resps
+}
+
+// listUpdates returns the list updates of n, including removals of configs and attributes
+// sent previously on the stream. Must be called with r.mu held.
+func (r *Responder) listUpdates(ls *listStream, n *Node) []interface{} {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+
+	var updates []interface{}
+	keys := make(map[string]bool)
+	add := func(k string, v interface{}) {
+		keys[k] = true
+		updates = append(updates, []interface{}{k, v})
+	}
+
+	for _, k := range sortedKeys(n.configs) {
+		add(k, n.configs[k])
+	}
+	if _, ok := n.configs["$invokable"]; !ok && n.action != nil {
+		add("$invokable", "write")
+	}
+	for _, k := range sortedKeys(n.attrs) {
+		add(k, n.attrs[k])
+	}
+	for _, c := range n.sortedChildren() {
+		updates = append(updates, []interface{}{c.name, c.summary()})
+	}
+
+	for k := range ls.keys {
+		if !keys[k] {
+			updates = append(updates, map[string]interface{}{"name": k, "change": "remove"})
+		}
+	}
+	ls.keys = keys
+	return updates
+}
+
+// childSummary returns the configs of n listed with its parent.
+func childSummary(n *Node) map[string]interface{} {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	return n.summary()
+}
+
+// summary returns the configs of n listed with its parent. Must be called with n.tree.mu held.
+func (n *Node) summary() map[string]interface{} {
+	m := make(map[string]interface{}, len(n.configs)+1)
+	for k, v := range n.configs {
+		m[k] = v
+	}
+	if _, ok := m["$invokable"]; !ok && n.action != nil {
+		m["$invokable"] = "write"
+	}
+	if len(n.children) > 0 {
+		m["$hasChildren"] = true
+	}
+	return m
+}
+
+// valueOf returns the subscription update of the value of n. Returns false if n has no value.
+func valueOf(n *Node) (update, bool) {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+
+	if !n.hasValue {
+		return update{}, false
+	}
+	return update{Value: n.value, Ts: n.ts.Format(conn.TimeFormat), Status: n.status}, true
+}
+
+// columns returns the $columns config v of the action at path as a list. Slices of any type,
+// such as []map[string]interface{}, are converted.
+func columns(path string, v interface{}) []interface{} {
+	if cols, ok := v.([]interface{}); ok {
+		return cols
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		log.Warnf("Ignoring $columns of %s, which is a %T rather than a list", path, v)
+		return nil
+	}
+	cols := make([]interface{}, rv.Len())
+	for i := range cols {
+		cols[i] = rv.Index(i).Interface()
+	}
+	return cols
+}
+
+// permission returns the permission of req, which is limited by its permit. Requests
+// without a permit have the full permission of the broker.
+func permission(req *conn.Request) conn.Permission {
+	if req.Permit == "" {
+		return conn.PermissionConfig
+	}
+	p, ok := conn.ParsePermission(req.Permit)
+	if !ok {
+		return conn.PermissionNone
+	}
+	return p
+}
+
+func denied(method, path string) *conn.Error {
+	return conn.NewError(conn.ErrPermissionDenied, "no permission to %s %s", method, path)
+}
+
+// responseError converts an error returned by a handler to the error of a response.
+func responseError(err error) *conn.Error {
+	if err == nil {
+		return nil
+	}
+	var ce *conn.Error
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return &conn.Error{Type: conn.ErrFailure, Msg: err.Error()}
+}
+
+// isKey reports whether name is the name of an attribute or config rather than a node.
+func isKey(name string) bool {
+	return strings.HasPrefix(name, "@") || strings.HasPrefix(name, "$")
+}
+
+func lastName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,291 @@
+package node
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/butlermatt/dslink/conn"
+)
+
+// testResponder records the responses of a Responder.
+type testResponder struct {
+	*Responder
+	mu    sync.Mutex
+	resps []*conn.Response
+}
+
+func newTestResponder(tree *Tree, opts ...func(r *Responder)) *testResponder {
+	tr := &testResponder{}
+	tr.Responder = NewResponder(tree, func(resp *conn.Response) {
+		tr.mu.Lock()
+		tr.resps = append(tr.resps, resp)
+		tr.mu.Unlock()
+	}, opts...)
+	return tr
+}
+
+// take returns and clears the recorded responses.
+func (tr *testResponder) take() []*conn.Response {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	resps := tr.resps
+	tr.resps = nil
+	return resps
+}
+
+// closed handles req and returns the error of its closed response.
+func (tr *testResponder) closed(t *testing.T, req *conn.Request) *conn.Error {
+	t.Helper()
+	tr.Handle(req)
+	resps := tr.take()
+	last := resps[len(resps)-1]
+	if last.Rid != req.Rid || last.Stream != conn.StreamClosed {
+		t.Fatalf("Expected closed response to rid %d got=%+v", req.Rid, last)
+	}
+	return last.Error
+}
+
+func TestResponder_List(t *testing.T) {
+	tree := NewTree()
+	a, _ := tree.Root().CreateChild("a", DisplayName("A"), Attribute("@unit", "C"))
+	_, _ = a.CreateChild("act", OnInvoke(func(*Node, map[string]interface{}) ([][]interface{}, error) { return nil, nil }))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodList, Path: "/a"})
+	resps := r.take()
+	exp := []interface{}{
+		[]interface{}{"$is", "node"},
+		[]interface{}{"$name", "A"},
+		[]interface{}{"@unit", "C"},
+		[]interface{}{"act", map[string]interface{}{"$is": "node", "$invokable": "write"}},
+	}
+	if len(resps) != 1 || resps[0].Stream != conn.StreamOpen || !reflect.DeepEqual(resps[0].Updates, exp) {
+		t.Fatalf("Unexpected list response: %+v", resps)
+	}
+
+	// Changes to the node and its children update the stream.
+	a.SetAttribute("@unit", nil)
+	resps = r.take()
+	if len(resps) != 1 || !reflect.DeepEqual(resps[0].Updates[len(resps[0].Updates)-1], map[string]interface{}{"name": "@unit", "change": "remove"}) {
+		t.Errorf("Unexpected list update on removed attribute: %+v", resps)
+	}
+	_, _ = a.CreateChild("b")
+	if resps = r.take(); len(resps) != 1 || resps[0].Updates[0].([]interface{})[0] != "b" {
+		t.Errorf("Unexpected list update on added child: %+v", resps)
+	}
+	a.RemoveChild("b")
+	if resps = r.take(); len(resps) != 1 || !reflect.DeepEqual(resps[0].Updates[0], map[string]interface{}{"name": "b", "change": "remove"}) {
+		t.Errorf("Unexpected list update on removed child: %+v", resps)
+	}
+
+	// Closed streams are no longer updated.
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodClose})
+	a.SetConfig("$name", "B")
+	if resps = r.take(); len(resps) != 0 {
+		t.Errorf("Closed list stream was updated: %+v", resps)
+	}
+
+	if err := r.closed(t, &conn.Request{Rid: 2, Method: conn.MethodList, Path: "/missing"}); err == nil || err.Type != conn.ErrInvalidPath {
+		t.Errorf("Unexpected error listing missing node: %v", err)
+	}
+}
+
+func TestResponder_Subscribe(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Type(TypeNumber), Value(1.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/n", Sid: 5}}})
+	resps := r.take()
+	if len(resps) != 2 || resps[0].Updates[0].([]interface{})[1] != 1.0 || resps[1].Stream != conn.StreamClosed {
+		t.Fatalf("Unexpected subscribe responses: %+v", resps)
+	}
+
+	n.SetValue(2.0)
+	resps = r.take()
+	if len(resps) != 1 {
+		t.Fatalf("Expected one update got=%+v", resps)
+	}
+	if u := resps[0].Updates[0].([]interface{}); u[0] != int32(5) || u[1] != 2.0 {
+		t.Errorf("Unexpected subscription update: %v", u)
+	}
+
+	if err := r.closed(t, &conn.Request{Rid: 2, Method: conn.MethodUnsubscribe, Sids: []int32{5}}); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	n.SetValue(3.0)
+	if resps = r.take(); len(resps) != 0 {
+		t.Errorf("Unsubscribed sid was updated: %+v", resps)
+	}
+}
+
+func TestResponder_Status(t *testing.T) {
+	tree := NewTree()
+	dev, _ := tree.Root().CreateChild("dev")
+	n, _ := dev.CreateChild("n", Value(1.0))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	subscribe(r, 1, "/dev/n", QosLatest)
+	dev.MarkSubtree(conn.StatusStale)
+	vus := sentUpdates(t, r.take(), 1)
+	if len(vus) != 1 || vus[0].Value != 1.0 || vus[0].Status != conn.StatusStale {
+		t.Errorf("Unexpected update on stale subtree: %+v", vus)
+	}
+
+	// Subscribing sends the current status.
+	vus = sentUpdates(t, subscribe(r, 2, "/dev/n", QosLatest), 2)
+	if len(vus) != 1 || vus[0].Status != conn.StatusStale {
+		t.Errorf("Unexpected update on subscribe: %+v", vus)
+	}
+
+	n.SetValue(2.0)
+	vus = sentUpdates(t, r.take(), 1)
+	if len(vus) != 1 || vus[0].Status != conn.StatusOk {
+		t.Errorf("Unexpected update after value set: %+v", vus)
+	}
+}
+
+func TestResponder_Set(t *testing.T) {
+	tree := NewTree()
+	n, _ := tree.Root().CreateChild("n", Type(TypeNumber), Writable("write"), OnSet(func(n *Node, v interface{}) (interface{}, error) {
+		if v.(float64) < 0 {
+			return nil, errors.New("negative")
+		}
+		return v.(float64) * 2, nil
+	}))
+	_, _ = tree.Root().CreateChild("ro", Type(TypeNumber))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/n", Sid: 1}}})
+	r.take()
+
+	if err := r.closed(t, &conn.Request{Rid: 2, Method: conn.MethodSet, Path: "/n", Value: 4}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if v, _ := n.Value(); v != 8.0 {
+		t.Errorf("Value expected=8 got=%v", v)
+	}
+
+	tests := []struct {
+		path  string
+		value interface{}
+		typ   string
+	}{
+		{"/n", "x", conn.ErrInvalidValue},
+		{"/n", -1, conn.ErrFailure},
+		{"/ro", 1, conn.ErrPermissionDenied},
+		{"/missing", 1, conn.ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		err := r.closed(t, &conn.Request{Rid: 3, Method: conn.MethodSet, Path: tt.path, Value: tt.value})
+		if err == nil || err.Type != tt.typ {
+			t.Errorf("Set %s to %v expected error %s got=%v", tt.path, tt.value, tt.typ, err)
+		}
+	}
+
+	// Attributes may be set and removed.
+	if err := r.closed(t, &conn.Request{Rid: 4, Method: conn.MethodSet, Path: "/ro/@unit", Value: "C"}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if v, _ := tree.Get("/ro").Attribute("@unit"); v != "C" {
+		t.Errorf("Attribute expected=%q got=%v", "C", v)
+	}
+	if err := r.closed(t, &conn.Request{Rid: 5, Method: conn.MethodRemove, Path: "/ro/@unit"}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, ok := tree.Get("/ro").Attribute("@unit"); ok {
+		t.Error("Attribute was not removed")
+	}
+}
+
+func TestResponder_Invoke(t *testing.T) {
+	tree := NewTree()
+	_, _ = tree.Root().CreateChild("act", Config("$columns", []interface{}{map[string]interface{}{"name": "r", "type": "number"}}),
+		OnInvoke(func(n *Node, params map[string]interface{}) ([][]interface{}, error) {
+			if params["fail"] == true {
+				return nil, conn.NewError(conn.ErrInvalidParameter, "bad")
+			}
+			return [][]interface{}{{1}}, nil
+		}))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	r.Handle(&conn.Request{Rid: 1, Method: conn.MethodInvoke, Path: "/act"})
+	resps := r.take()
+	if len(resps) != 1 || resps[0].Stream != conn.StreamClosed || len(resps[0].Columns) != 1 || !reflect.DeepEqual(resps[0].Updates, []interface{}{[]interface{}{1}}) {
+		t.Errorf("Unexpected invoke response: %+v", resps)
+	}
+
+	err := r.closed(t, &conn.Request{Rid: 2, Method: conn.MethodInvoke, Path: "/act", Params: map[string]interface{}{"fail": true}})
+	if err == nil || err.Type != conn.ErrInvalidParameter {
+		t.Errorf("Unexpected invoke error: %v", err)
+	}
+
+	if err = r.closed(t, &conn.Request{Rid: 3, Method: "bogus"}); err == nil || err.Type != conn.ErrInvalidMethod {
+		t.Errorf("Unexpected error for unknown method: %v", err)
+	}
+
+	// Columns of other slice types are converted.
+	cols := []map[string]interface{}{{"name": "a", "type": "string"}, {"name": "b", "type": "number"}}
+	_, _ = tree.Root().CreateChild("typed", Config("$columns", cols), OnInvoke(func(*Node, map[string]interface{}) ([][]interface{}, error) { return nil, nil }))
+	r.Handle(&conn.Request{Rid: 4, Method: conn.MethodInvoke, Path: "/typed"})
+	if resps = r.take(); len(resps) != 1 || len(resps[0].Columns) != 2 || !reflect.DeepEqual(resps[0].Columns[1], cols[1]) {
+		t.Errorf("Unexpected columns of typed invoke response: %+v", resps)
+	}
+}
+
+func TestResponder_Permissions(t *testing.T) {
+	tree := NewTree()
+	noop := func(*Node, map[string]interface{}) ([][]interface{}, error) { return nil, nil }
+	_, _ = tree.Root().CreateChild("w", Type(TypeNumber), Writable("write"))
+	_, _ = tree.Root().CreateChild("c", Type(TypeNumber), Writable("config"))
+	_, _ = tree.Root().CreateChild("act", OnInvoke(noop))
+	_, _ = tree.Root().CreateChild("read", Invokable("read"), OnInvoke(noop))
+	_, _ = tree.Root().CreateChild("never", Invokable("never"), OnInvoke(noop))
+	r := newTestResponder(tree)
+	defer r.Close()
+
+	tests := []struct {
+		req     *conn.Request
+		allowed bool
+	}{
+		{&conn.Request{Method: conn.MethodList, Path: "/", Permit: "list"}, true},
+		{&conn.Request{Method: conn.MethodList, Path: "/", Permit: "none"}, false},
+		{&conn.Request{Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/w", Sid: 1}}, Permit: "read"}, true},
+		{&conn.Request{Method: conn.MethodSubscribe, Paths: []*conn.SubscribePath{{Path: "/w", Sid: 2}}, Permit: "list"}, false},
+		{&conn.Request{Method: conn.MethodSet, Path: "/w", Value: 1, Permit: "write"}, true},
+		{&conn.Request{Method: conn.MethodSet, Path: "/w", Value: 1, Permit: "read"}, false},
+		{&conn.Request{Method: conn.MethodSet, Path: "/c", Value: 1, Permit: "write"}, false},
+		{&conn.Request{Method: conn.MethodSet, Path: "/c", Value: 1}, true},
+		{&conn.Request{Method: conn.MethodSet, Path: "/w/@unit", Value: "C", Permit: "write"}, true},
+		{&conn.Request{Method: conn.MethodSet, Path: "/w/$name", Value: "W", Permit: "write"}, false},
+		{&conn.Request{Method: conn.MethodSet, Path: "/w/$name", Value: "W", Permit: "config"}, true},
+		{&conn.Request{Method: conn.MethodRemove, Path: "/w/@unit", Permit: "read"}, false},
+		{&conn.Request{Method: conn.MethodRemove, Path: "/w/@unit", Permit: "write"}, true},
+		{&conn.Request{Method: conn.MethodInvoke, Path: "/act", Permit: "read"}, false},
+		{&conn.Request{Method: conn.MethodInvoke, Path: "/act", Permit: "write"}, true},
+		{&conn.Request{Method: conn.MethodInvoke, Path: "/read", Permit: "read"}, true},
+		{&conn.Request{Method: conn.MethodInvoke, Path: "/never"}, false},
+		{&conn.Request{Method: conn.MethodList, Path: "/", Permit: "bogus"}, false},
+	}
+	for i, tt := range tests {
+		tt.req.Rid = int32(i + 1)
+		r.Handle(tt.req)
+		resps := r.take()
+		last := resps[len(resps)-1]
+		denied := last.Error != nil && last.Error.Type == conn.ErrPermissionDenied
+		if denied == tt.allowed {
+			t.Errorf("%s %s with permit %q expected allowed=%v got=%+v", tt.req.Method, tt.req.Path, tt.req.Permit, tt.allowed, last.Error)
+		}
+	}
+
+	if v, _ := tree.Get("/w").Config("$name"); v != "W" {
+		t.Errorf("Config set by request expected=%q got=%v", "W", v)
+	}
+}
@@ -0,0 +1,273 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+	"github.com/butlermatt/dslink/internal/fsutil"
+	"github.com/butlermatt/dslink/log"
+)
+
+// DefaultNodesFile is the file a link's node tree is conventionally saved to.
+const DefaultNodesFile = "nodes.json"
+
+// valueKey is the key of a node's value in its serialized form.
+const valueKey = "?value"
+
+// Profile initializes a node of the type named by its $is config, such as by setting its
+// action. Profiles rebuild the parts of a node which are not serialized, so nodes created at
+// runtime may be restored from nodes.json. A restored node's children are restored before its
+// profile is applied, so a profile should use Child before creating a child, and should create
+// children which only hold an action as Transient so they are rebuilt with their action.
+type Profile func(n *Node)
+
+// Serialize returns the serializable form of n and its children. Configs and attributes are
+// stored under their keys, the value under ?value and children under their names. Transient
+// nodes are omitted.
+func (n *Node) Serialize() map[string]interface{} {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	return n.serialize()
+}
+
+func (n *Node) serialize() map[string]interface{} {
+	m := make(map[string]interface{}, len(n.configs)+len(n.attrs)+len(n.children)+1)
+	for k, v := range n.configs {
+		m[k] = v
+	}
+	for k, v := range n.attrs {
+		m[k] = v
+	}
+	if n.hasValue {
+		m[valueKey] = n.value
+	}
+	for name, c := range n.children {
+		if !c.transient {
+			m[name] = c.serialize()
+		}
+	}
+	return m
+}
+
+// Restore rebuilds the children of n from their serialized form. Nodes which already exist
+// have their configs, attributes and value restored. New nodes are initialized with the
+// registered profile named by their $is config.
+func (n *Node) Restore(m map[string]interface{}) error {
+	var restored []*Node
+	n.tree.mu.Lock()
+	err := n.restore(m, &restored)
+	n.tree.mu.Unlock()
+
+	// Profiles are applied without the lock held, as they usually modify the node.
+	for _, c := range restored {
+		n.tree.initialize(c)
+	}
+
+	n.tree.changed(n, changeNode)
+	return err
+}
+
+func (n *Node) restore(m map[string]interface{}, restored *[]*Node) error {
+	for k, v := range m {
+		switch {
+		case k == valueKey:
+			n.value = v
+			n.ts = time.Now()
+			n.hasValue = true
+		case strings.HasPrefix(k, "$"):
+			n.configs[k] = v
+		case strings.HasPrefix(k, "@"):
+			n.attrs[k] = v
+		default:
+			cm, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("node %s has invalid child %q", n.path, k)
+			}
+			if err := validName(k); err != nil {
+				return err
+			}
+
+			c, ok := n.children[k]
+			if !ok {
+				c = newNode(n.tree, n, k, conn.JoinPath(n.path, k))
+				c.configs["$is"] = "node"
+				n.children[k] = c
+				*restored = append(*restored, c)
+			}
+			if err := c.restore(cm, restored); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveFile writes the serialized tree to the file at path. The file is replaced atomically,
+// so an interrupted save never leaves a partially written file.
+func (t *Tree) SaveFile(path string) error {
+	b, err := json.MarshalIndent(t.root.Serialize(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode nodes: %v", err)
+	}
+	if err = fsutil.WriteFileAtomic(path, b, 0644); err != nil {
+		return fmt.Errorf("unable to save nodes to %q: %v", path, err)
+	}
+	return nil
+}
+
+// LoadFile restores the tree from the file at path. It is not an error for the file to not
+// exist, as a link has no saved nodes the first time it starts.
+func (t *Tree) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read nodes from %q: %v", path, err)
+	}
+
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("unable to decode nodes from %q: %v", path, err)
+	}
+	return t.root.Restore(m)
+}
+
+// Saver saves a tree to a file when it changes, and periodically while it has unsaved changes.
+type Saver struct {
+	tree     *Tree
+	path     string
+	debounce time.Duration
+	interval time.Duration
+
+	cancel  func()
+	changes chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// Debounce saves the tree at most once per d after it changes. A d of 0 disables saving on
+// change. The default is one second.
+func Debounce(d time.Duration) func(s *Saver) {
+	return func(s *Saver) {
+		s.debounce = d
+	}
+}
+
+// Interval saves the tree every d if it has unsaved changes. A d of 0 disables periodic
+// saving. The default is one minute.
+func Interval(d time.Duration) func(s *Saver) {
+	return func(s *Saver) {
+		s.interval = d
+	}
+}
+
+// NewSaver starts saving the tree t to the file at path. The caller should call Close when
+// finished, which saves any remaining changes.
+func NewSaver(t *Tree, path string, opts ...func(s *Saver)) *Saver {
+	s := &Saver{
+		tree:     t,
+		path:     path,
+		debounce: time.Second,
+		interval: time.Minute,
+		changes:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.cancel = t.listen(func(n *Node, _ change) {
+		if n.isTransient() {
+			return
+		}
+		select {
+		case s.changes <- struct{}{}:
+		default:
+		}
+	})
+
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Close stops the Saver and saves any unsaved changes.
+func (s *Saver) Close() error {
+	s.once.Do(func() {
+		s.cancel()
+		close(s.done)
+	})
+	s.wg.Wait()
+
+	select {
+	case <-s.changes:
+		return s.tree.SaveFile(s.path)
+	default:
+		return nil
+	}
+}
+
+func (s *Saver) run() {
+	defer s.wg.Done()
+
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var debounce <-chan time.Time
+	dirty := false
+	for {
+		select {
+		case <-s.changes:
+			dirty = true
+			if s.debounce > 0 && debounce == nil {
+				debounce = time.After(s.debounce)
+			}
+			continue
+		case <-debounce:
+		case <-tick:
+			if !dirty {
+				continue
+			}
+		case <-s.done:
+			if dirty {
+				// Leave a pending change for Close to save.
+				select {
+				case s.changes <- struct{}{}:
+				default:
+				}
+			}
+			return
+		}
+
+		debounce = nil
+		dirty = false
+		if err := s.tree.SaveFile(s.path); err != nil {
+			log.Warnf("Unable to save nodes: %v", err)
+		}
+	}
+}
+
+// isTransient returns true if n or any of its ancestors is transient.
+func (n *Node) isTransient() bool {
+	n.tree.mu.RLock()
+	defer n.tree.mu.RUnlock()
+	for ; n != nil; n = n.parent {
+		if n.transient {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testTree() *Tree {
+	tree := NewTree()
+	dev, _ := tree.Root().CreateChild("dev", Config("$is", "device"), Attribute("@host", "10.0.0.1"))
+	_, _ = dev.CreateChild("temp", Type("number"), Value(21.5))
+	_, _ = tree.Root().CreateChild("status", Transient, Value("ok"))
+	return tree
+}
+
+func TestNode_Serialize(t *testing.T) {
+	got := testTree().Root().Serialize()
+	exp := map[string]interface{}{
+		"$is": "node",
+		"dev": map[string]interface{}{
+			"$is":   "device",
+			"@host": "10.0.0.1",
+			"temp": map[string]interface{}{
+				"$is":    "node",
+				"$type":  "number",
+				"?value": 21.5,
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Serialize expected=%v got=%v", exp, got)
+	}
+}
+
+func TestNode_Restore(t *testing.T) {
+	b, _ := json.Marshal(testTree().Root().Serialize())
+	var m map[string]interface{}
+	_ = json.Unmarshal(b, &m)
+
+	tree := NewTree()
+	// Existing nodes keep their action and have their value restored.
+	static, _ := tree.Root().CreateChild("dev", OnInvoke(func(n *Node, _ map[string]interface{}) ([][]interface{}, error) {
+		return nil, nil
+	}))
+
+	var restored []string
+	device := func(n *Node) { restored = append(restored, n.Path()) }
+	tree.AddProfile("device", device)
+	if err := tree.Root().Restore(m); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if tree.Get("/dev") != static {
+		t.Error("Existing node was replaced")
+	}
+	if len(restored) != 0 {
+		t.Errorf("Profile applied to existing node: %v", restored)
+	}
+	if v, _ := tree.Get("/dev/temp").Value(); v != 21.5 {
+		t.Errorf("Restored value expected=21.5 got=%v", v)
+	}
+	if v, _ := tree.Get("/dev").Attribute("@host"); v != "10.0.0.1" {
+		t.Errorf("Restored attribute expected=%q got=%v", "10.0.0.1", v)
+	}
+
+	// New nodes are initialized with their profile.
+	tree = NewTree()
+	tree.AddProfile("device", device)
+	if err := tree.Root().Restore(m); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !reflect.DeepEqual(restored, []string{"/dev"}) {
+		t.Errorf("Profiles applied expected=[/dev] got=%v", restored)
+	}
+
+	if err := NewTree().Root().Restore(map[string]interface{}{"bad": 1}); err == nil {
+		t.Error("Expected error restoring invalid child")
+	}
+}
+
+func TestTree_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultNodesFile)
+
+	if err := NewTree().LoadFile(path); err != nil {
+		t.Error("Unexpected error loading missing file", err)
+	}
+
+	if err := testTree().SaveFile(path); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	tree := NewTree()
+	if err := tree.LoadFile(path); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if tree.Get("/dev/temp") == nil || tree.Get("/status") != nil {
+		t.Error("Loaded tree does not match saved tree")
+	}
+
+	_ = ioutil.WriteFile(path, []byte("{"), 0644)
+	if err := tree.LoadFile(path); err == nil {
+		t.Error("Expected error loading invalid file")
+	}
+}
+
+func loadValue(t *testing.T, path string) interface{} {
+	t.Helper()
+	tree := NewTree()
+	if err := tree.LoadFile(path); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	n := tree.Get("/n")
+	if n == nil {
+		return nil
+	}
+	v, _ := n.Value()
+	return v
+}
+
+func TestSaver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultNodesFile)
+	tree := NewTree()
+	s := NewSaver(tree, path, Debounce(20*time.Millisecond), Interval(0))
+
+	n, _ := tree.Root().CreateChild("n", Value(1.0))
+	n.SetValue(2.0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for loadValue(t, path) != 2.0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Tree was not saved after change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+}
+
+func TestSaver_Close(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultNodesFile)
+	tree := NewTree()
+	s := NewSaver(tree, path, Debounce(time.Hour), Interval(0))
+
+	// Changes to transient nodes do not need saving.
+	_, _ = tree.Root().CreateChild("tmp", Transient, Value(1))
+	if err := s.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Transient change was saved: %v", err)
+	}
+
+	// Close saves pending changes.
+	s = NewSaver(tree, path, Debounce(time.Hour), Interval(0))
+	_, _ = tree.Root().CreateChild("n", Value(3.0))
+	if err := s.Close(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if v := loadValue(t, path); v != 3.0 {
+		t.Errorf("Saved value after Close expected=3 got=%v", v)
+	}
+}
+
+func TestSaver_Interval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultNodesFile)
+	tree := NewTree()
+	s := NewSaver(tree, path, Debounce(0), Interval(20*time.Millisecond))
+	defer s.Close()
+
+	_, _ = tree.Root().CreateChild("n", Value("a"))
+	deadline := time.Now().Add(2 * time.Second)
+	for loadValue(t, path) != "a" {
+		if time.Now().After(deadline) {
+			t.Fatal("Tree was not saved periodically")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"strings"
+	"time"
+
+	"github.com/butlermatt/dslink/conn"
+)
+
+// Value types of the $type config.
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeBool    = "bool"
+	TypeMap     = "map"
+	TypeArray   = "array"
+	TypeBinary  = "binary"
+	TypeTime    = "time"
+	TypeDynamic = "dynamic"
+)
+
+// Enum returns the $type of an enum with the specified options, such as enum[off,on].
+func Enum(options ...string) string {
+	return "enum[" + strings.Join(options, ",") + "]"
+}
+
+// CheckValue checks that v is a valid value of the $type typ. Numbers are converted to
+// float64, and the option names of a bool[false,true] type are converted to bools.
+// Returns an invalidValue error if v is not valid. Unknown types accept any value.
+//
+// A nil v is valid for every type, since it clears the value of a node. Enum values must
+// be one of the option names of the type; option indexes are not accepted.
+func CheckValue(typ string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	base, options := parseType(typ)
+	switch base {
+	case TypeString:
+		if _, ok := v.(string); ok {
+			return v, nil
+		}
+	case TypeNumber:
+		if f, ok := conn.Float64(v); ok {
+			return f, nil
+		}
+	case TypeBool:
+		if _, ok := v.(bool); ok {
+			return v, nil
+		}
+		if s, ok := v.(string); ok && len(options) == 2 {
+			if s == options[0] {
+				return false, nil
+			}
+			if s == options[1] {
+				return true, nil
+			}
+		}
+	case "enum":
+		if s, ok := v.(string); ok {
+			for _, o := range options {
+				if s == o {
+					return v, nil
+				}
+			}
+			return nil, conn.NewError(conn.ErrInvalidValue, "%q is not one of %s", s, typ)
+		}
+	case TypeMap:
+		if _, ok := v.(map[string]interface{}); ok {
+			return v, nil
+		}
+	case TypeArray:
+		if _, ok := v.([]interface{}); ok {
+			return v, nil
+		}
+	case TypeBinary:
+		if _, ok := v.([]byte); ok {
+			return v, nil
+		}
+	case TypeTime:
+		if s, ok := v.(string); ok {
+			if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return v, nil
+			}
+		}
+	default:
+		return v, nil
+	}
+
+	return nil, conn.NewError(conn.ErrInvalidValue, "%v is not a valid %s", v, typ)
+}
+
+// parseType splits a $type such as enum[a,b] into its base type and options.
+func parseType(typ string) (string, []string) {
+	i := strings.IndexByte(typ, '[')
+	if i < 0 || !strings.HasSuffix(typ, "]") {
+		return typ, nil
+	}
+	return typ[:i], strings.Split(typ[i+1:len(typ)-1], ",")
+}
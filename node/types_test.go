@@ -0,0 +1,57 @@
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/butlermatt/dslink/conn"
+)
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		typ string
+		v   interface{}
+		exp interface{}
+	}{
+		{TypeString, "a", "a"},
+		{TypeNumber, int8(3), 3.0},
+		{TypeNumber, uint32(7), 7.0},
+		{TypeNumber, 1.5, 1.5},
+		{TypeBool, true, true},
+		{"bool[off,on]", "on", true},
+		{"bool[off,on]", "off", false},
+		{Enum("low", "high"), "high", "high"},
+		{TypeTime, "2020-01-02T03:04:05.000Z", "2020-01-02T03:04:05.000Z"},
+		{TypeDynamic, 1, 1},
+		{"", "x", "x"},
+		{TypeNumber, nil, nil},
+		{Enum("low", "high"), nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := CheckValue(tt.typ, tt.v)
+		if err != nil || got != tt.exp {
+			t.Errorf("CheckValue(%q, %v) expected=%v got=%v %v", tt.typ, tt.v, tt.exp, got, err)
+		}
+	}
+
+	invalid := []struct {
+		typ string
+		v   interface{}
+	}{
+		{TypeString, 1},
+		{TypeNumber, "1"},
+		{"bool[off,on]", "maybe"},
+		{Enum("low", "high"), "mid"},
+		{Enum("low", "high"), 1},
+		{TypeMap, []interface{}{}},
+		{TypeArray, map[string]interface{}{}},
+		{TypeTime, "yesterday"},
+	}
+	for _, tt := range invalid {
+		_, err := CheckValue(tt.typ, tt.v)
+		var ce *conn.Error
+		if !errors.As(err, &ce) || ce.Type != conn.ErrInvalidValue {
+			t.Errorf("CheckValue(%q, %v) expected invalidValue got=%v", tt.typ, tt.v, err)
+		}
+	}
+}